@@ -0,0 +1,60 @@
+package main
+
+// A batch collects the events bound for a single Parquet object.
+
+import (
+	"time"
+)
+
+type batch struct {
+	partition string // Object directory, relative to basedir
+	path      string // Object path
+	schema    *Schema
+	pqwr      *Writer
+	sink      Sink
+	acks      []chan error // Handlers waiting for the upload
+	items     int64
+	opened    time.Time
+	used      time.Time
+}
+
+// Starts a batch writing to sink.
+func newBatch(partition string, path string, schema *Schema,
+	sink Sink) (*batch, error) {
+
+	b := &batch{
+		partition: partition,
+		path:      path,
+		schema:    schema,
+		sink:      sink,
+		opened:    time.Now(),
+	}
+
+	var err error
+	b.pqwr, err = NewWriter(sink, schema, writerOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+
+}
+
+// Adds an event to the batch.
+func (b *batch) Write(oe QueueItem) error {
+
+	//convert to parquet format using parquet writer
+	err := b.pqwr.Write(b.schema.Row(oe.event))
+	if err != nil {
+		return err
+	}
+
+	b.items += 1
+	b.used = time.Now()
+	if oe.stored != nil {
+		b.acks = append(b.acks, oe.stored)
+	}
+
+	return nil
+
+}
@@ -3,10 +3,12 @@ package main
 // Code for converting a cyberprobe Event object into a FlatEvent which can be
 // parquet-serialised.
 
-// FIXME: The set of selected HTTP headers to serialise is mainly arbitrary
-
 import (
+	"crypto/sha1"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -17,7 +19,47 @@ import (
 // A flattener takes Event objects and outputs FlatEvent objects.  This
 // object makes the flattener configurable.
 type Flattener struct {
-	WritePayloads bool
+
+	// Which payloads are written.
+	WriteHttpBody        bool
+	WriteIcmpPayload     bool
+	WriteDatagramPayload bool
+	WriteStreamPayload   bool
+
+	// Payloads longer than this are truncated, 0 for no limit.
+	MaxPayloadLength int
+
+	// If set, payloads are put here rather than in the Parquet file,
+	// leaving just their hash and length in the FlatEvent.
+	Payloads PayloadStore
+
+	// Use the time the event was received if its own time can't be
+	// parsed, rather than 1970.
+	ReceiveTimeFallback bool
+
+	// Write credential headers as they are, rather than redacted.
+	WriteCredentialHeaders bool
+}
+
+// Headers carrying credentials.  Unless WriteCredentialHeaders is set these
+// are written as redactedHeader, so queries can see a credential was sent
+// without the data lake holding it.  Authorization keeps its scheme.
+var credentialHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+}
+
+const redactedHeader = "REDACTED"
+
+// Event time formats accepted, RFC 3339 with any fractional precision.  A
+// time without an offset is taken as UTC.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
 }
 
 // FlatEvent, similar to the cyberprobe Event, but no structure, useful for
@@ -37,10 +79,24 @@ type FlatEvent struct {
 	// Would like to use TIMESTAMP_MICROS but Spark isn't happy about that.
 	TimeMicros int64 `parquet:"name=time_micros, type=INT64"`
 
+	// Event time as a proper timestamp.  Which representation is written
+	// depends on EVENT_TIME_TYPE, INT96 suits older Spark.
+	EventTimeMillis int64  `parquet:"name=event_time, type=TIMESTAMP_MILLIS"`
+	EventTimeMicros int64  `parquet:"name=event_time, type=TIMESTAMP_MICROS"`
+	EventTimeInt96  string `parquet:"name=event_time, type=INT96"`
+
+	// Set if the event's time couldn't be parsed.
+	TimeParseError bool `parquet:"name=time_parse_error, type=BOOLEAN"`
+
 	Network string  `parquet:"name=network, type=UTF8, encoding=PLAIN_DICTIONARY"`
 	Url     string  `parquet:"name=url, type=UTF8, encoding=PLAIN_DICTIONARY"`
 	Risk    float64 `parquet:"name=risk, type=DOUBLE"`
 
+	// Full address stacks, outermost first, as cyberprobe gives them e.g.
+	// ipv4:10.0.0.1, tcp:443.  The _0 columns below are a convenience.
+	Src  []string `parquet:"name=src, type=LIST, valuetype=UTF8"`
+	Dest []string `parquet:"name=dest, type=LIST, valuetype=UTF8"`
+
 	// Addresses
 	SrcIpv4  string `parquet:"name=src_ipv4_0, type=UTF8, encoding=PLAIN_DICTIONARY"`
 	SrcIpv6  string `parquet:"name=src_ipv6_0, type=UTF8, encoding=PLAIN_DICTIONARY"`
@@ -51,6 +107,13 @@ type FlatEvent struct {
 	DestTcp  int32  `parquet:"name=dest_tcp_0, type=INT32"`
 	DestUdp  int32  `parquet:"name=dest_udp_0, type=INT32"`
 
+	// The addresses above in binary, for range queries.  Null where there
+	// is no address.
+	SrcIpv4Int    *int64  `parquet:"name=src_ipv4_int, type=INT64, repetitiontype=OPTIONAL"`
+	SrcIpv6Bytes  *string `parquet:"name=src_ipv6_bytes, type=FIXED_LEN_BYTE_ARRAY, length=16, repetitiontype=OPTIONAL"`
+	DestIpv4Int   *int64  `parquet:"name=dest_ipv4_int, type=INT64, repetitiontype=OPTIONAL"`
+	DestIpv6Bytes *string `parquet:"name=dest_ipv6_bytes, type=FIXED_LEN_BYTE_ARRAY, length=16, repetitiontype=OPTIONAL"`
+
 	// DNS
 	DnsMessageAnswerName0    string `parquet:"name=dns_message_answer_name_0, type=UTF8, encoding=PLAIN_DICTIONARY"`
 	DnsMessageAnswerName1    string `parquet:"name=dns_message_answer_name_1, type=UTF8, encoding=PLAIN_DICTIONARY"`
@@ -69,25 +132,14 @@ type FlatEvent struct {
 
 	DnsMessageType string `parquet:"name=dns_message_type, type=UTF8, encoding=PLAIN_DICTIONARY"`
 
-	// HTTP header
-	HttpHeader_Accept                    string `parquet:"name=http_header_Accept, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Accept_Encoding           string `parquet:"name=http_header_Accept_Encoding, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Accept_Language           string `parquet:"name=http_header_Accept_Language, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Cache_Control             string `parquet:"name=http_header_Cache_Control, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Connection                string `parquet:"name=http_header_Connection, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Host                      string `parquet:"name=http_header_Host, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Metadata_Flavor           string `parquet:"name=http_header_Metadata_Flavor, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Pragma                    string `parquet:"name=http_header_Pragma, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Referer                   string `parquet:"name=http_header_Referer, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Upgrade_Insecure_Requests string `parquet:"name=http_header_Upgrade_Insecure_Requests, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_User_Agent                string `parquet:"name=http_header_User_Agent, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Content_Length            string `parquet:"name=http_header_Content_Length, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Content_Type              string `parquet:"name=http_header_Content_Type, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Date                      string `parquet:"name=http_header_Date, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_ETag                      string `parquet:"name=http_header_ETag, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_Server                    string `parquet:"name=http_header_Server, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_X_Frame_Options           string `parquet:"name=http_header_X_Frame_Options, type=UTF8, encoding=PLAIN_DICTIONARY"`
-	HttpHeader_X_XSS_Protection          string `parquet:"name=http_header_X_XSS_Protection, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	// DNS, every query and answer.  Whether these or the fixed slot
+	// columns above are written depends on DNS_SCHEMA.
+	DnsMessageQuery  []FlatDnsQuery  `parquet:"name=dns_message_query, type=LIST"`
+	DnsMessageAnswer []FlatDnsAnswer `parquet:"name=dns_message_answer, type=LIST"`
+
+	// HTTP header, all of them.  Columns for individual headers are added
+	// by the Schema, see HTTP_PROMOTED_HEADERS.
+	HttpHeader map[string]string `parquet:"name=http_header, type=MAP, keytype=UTF8, valuetype=UTF8"`
 
 	// HTTP request
 	HttpRequestMethod string `parquet:"name=http_request_method, type=UTF8, encoding=PLAIN_DICTIONARY"`
@@ -97,13 +149,21 @@ type FlatEvent struct {
 	HttpResponseCode   int32  `parquet:"name=http_response_code, type=INT32"`
 
 	// Request or response body
-	HttpBody string `parquet:"name=http_body, type=BYTE_ARRAY"`
+	HttpBody       string `parquet:"name=http_body, type=BYTE_ARRAY"`
+	HttpBodyLength int64  `parquet:"name=http_body_length, type=INT64"`
+	HttpBodySha1   string `parquet:"name=http_body_sha1, type=UTF8, encoding=PLAIN_DICTIONARY"`
+
+	// Set if a payload was cut short by MAX_PAYLOAD_LENGTH
+	PayloadTruncated bool `parquet:"name=payload_truncated, type=BOOLEAN"`
 
 	// ICMP
 	IcmpCode    int32  `parquet:"name=icmp_code, type=INT32"`
 	IcmpPayload string `parquet:"name=icmp_payload, type=BYTE_ARRAY"`
 	IcmpType    int32  `parquet:"name=icmp_type, type=INT32"`
 
+	IcmpPayloadLength int64  `parquet:"name=icmp_payload_length, type=INT64"`
+	IcmpPayloadSha1   string `parquet:"name=icmp_payload_sha1, type=UTF8, encoding=PLAIN_DICTIONARY"`
+
 	// Location
 	LocationDestAccuracy    int32   `parquet:"name=location_dest_accuracy, type=INT32"`
 	LocationDestAsnum       int32   `parquet:"name=location_dest_asnum, type=INT32"`
@@ -164,6 +224,36 @@ type FlatEvent struct {
 	IndicatorCategory2    string `parquet:"name=indicator_category_2, type=UTF8, encoding=PLAIN_DICTIONARY"`
 	IndicatorAuthor2      string `parquet:"name=indicator_author_2, type=UTF8, encoding=PLAIN_DICTIONARY"`
 	IndicatorSource2      string `parquet:"name=indicator_source_2, type=UTF8, encoding=PLAIN_DICTIONARY"`
+
+	// Every indicator, and how many there are.
+	Indicators     []FlatIndicator `parquet:"name=indicators, type=LIST"`
+	IndicatorCount int32           `parquet:"name=indicator_count, type=INT32"`
+}
+
+// A DNS query, element of the dns_message_query list.
+type FlatDnsQuery struct {
+	Name  string `parquet:"name=name, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Type  string `parquet:"name=type, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Class string `parquet:"name=class, type=UTF8, encoding=PLAIN_DICTIONARY"`
+}
+
+// A DNS answer, element of the dns_message_answer list.
+type FlatDnsAnswer struct {
+	Name    string `parquet:"name=name, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Type    string `parquet:"name=type, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Class   string `parquet:"name=class, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Address string `parquet:"name=address, type=UTF8, encoding=PLAIN_DICTIONARY"`
+}
+
+// A threat indicator, element of the indicators list.
+type FlatIndicator struct {
+	Id          string `parquet:"name=id, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Type        string `parquet:"name=type, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Value       string `parquet:"name=value, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Description string `parquet:"name=description, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Category    string `parquet:"name=category, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Author      string `parquet:"name=author, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Source      string `parquet:"name=source, type=UTF8, encoding=PLAIN_DICTIONARY"`
 }
 
 // Decode Base64 string to a string
@@ -178,9 +268,96 @@ func Debase64(in string) string {
 
 }
 
+// Parse an event time.
+func ParseTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range timeLayouts {
+		var tm time.Time
+		tm, err = time.Parse(layout, s)
+		if err == nil {
+			return tm.UTC(), nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// Convert a time to a Parquet INT96 timestamp: nanoseconds into the day
+// followed by the Julian day number, both little-endian.
+func Int96Time(tm time.Time) string {
+
+	// Julian day number of 1970-01-01
+	const julianEpoch = 2440588
+
+	secs := tm.Unix()
+	days := secs / 86400
+	nanos := (secs%86400)*1000000000 + int64(tm.Nanosecond())
+	if nanos < 0 {
+		days -= 1
+		nanos += 86400 * 1000000000
+	}
+
+	b := make([]byte, 12)
+	binary.LittleEndian.PutUint64(b[0:8], uint64(nanos))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(days+julianEpoch))
+
+	return string(b)
+
+}
+
+// Convert an IPv4 address to an integer, nil if it isn't one.
+func Ipv4Int(addr string) *int64 {
+	ip := net.ParseIP(addr).To4()
+	if ip == nil {
+		return nil
+	}
+	v := int64(binary.BigEndian.Uint32(ip))
+	return &v
+}
+
+// Convert an IPv6 address to its 16 bytes, nil if it isn't one.
+func Ipv6Bytes(addr string) *string {
+	ip := net.ParseIP(addr)
+	if ip == nil || !strings.Contains(addr, ":") {
+		return nil
+	}
+	v := string(ip.To16())
+	return &v
+}
+
+// Decode a Base64 payload.  Returns what goes in the payload column, the
+// payload's length and its SHA-1, using hash if the event carries one.  The
+// column is empty if the payload went to the payload store, otherwise the
+// payload truncated to MaxPayloadLength.
+func (f *Flattener) Payload(in string, hash string, oe *FlatEvent) (string,
+	int, string) {
+
+	p := Debase64(in)
+
+	if !validSha1(hash) {
+		sum := sha1.Sum([]byte(p))
+		hash = hex.EncodeToString(sum[:])
+	}
+
+	if f.Payloads != nil {
+		f.Payloads.Put(hash, []byte(p))
+		return "", len(p), hash
+	}
+
+	length := len(p)
+	if f.MaxPayloadLength > 0 && len(p) > f.MaxPayloadLength {
+		p = p[:f.MaxPayloadLength]
+		oe.PayloadTruncated = true
+	}
+
+	return p, length, hash
+
+}
+
 // Flatten the source addresses
 func (f *Flattener) FlattenSrc(e *dt.Event, oe *FlatEvent) {
 
+	oe.Src = append([]string(nil), e.Src...)
+
 	for _, f := range e.Src {
 		if strings.HasPrefix(f, "ipv4:") {
 			oe.SrcIpv4 = f[5:]
@@ -197,11 +374,15 @@ func (f *Flattener) FlattenSrc(e *dt.Event, oe *FlatEvent) {
 			oe.SrcUdp = int32(port)
 		}
 	}
+	oe.SrcIpv4Int = Ipv4Int(oe.SrcIpv4)
+	oe.SrcIpv6Bytes = Ipv6Bytes(oe.SrcIpv6)
 }
 
 // Flatten the destination addresses
 func (f *Flattener) FlattenDest(e *dt.Event, oe *FlatEvent) {
 
+	oe.Dest = append([]string(nil), e.Dest...)
+
 	for _, f := range e.Dest {
 		if strings.HasPrefix(f, "ipv4:") {
 			oe.DestIpv4 = f[5:]
@@ -218,6 +399,8 @@ func (f *Flattener) FlattenDest(e *dt.Event, oe *FlatEvent) {
 			oe.DestUdp = int32(port)
 		}
 	}
+	oe.DestIpv4Int = Ipv4Int(oe.DestIpv4)
+	oe.DestIpv6Bytes = Ipv6Bytes(oe.DestIpv6)
 }
 
 // Flatten DNS information
@@ -265,71 +448,64 @@ func (f *Flattener) FlattenDnsMessage(e *dt.Event, oe *FlatEvent) {
 				e.DnsMessage.Answer[4].Address
 		}
 	}
+
+	// Everything, for the nested columns
+	for _, q := range e.DnsMessage.Query {
+		oe.DnsMessageQuery = append(oe.DnsMessageQuery, FlatDnsQuery{
+			Name:  q.Name,
+			Type:  q.Type,
+			Class: q.Class,
+		})
+	}
+	for _, a := range e.DnsMessage.Answer {
+		oe.DnsMessageAnswer = append(oe.DnsMessageAnswer, FlatDnsAnswer{
+			Name:    a.Name,
+			Type:    a.Type,
+			Class:   a.Class,
+			Address: a.Address,
+		})
+	}
 }
 
 // Flatten HTTP information
 func (f *Flattener) FlattenHttpHeader(header map[string]string, oe *FlatEvent) {
-	if v, ok := header["Accept"]; ok {
-		oe.HttpHeader_Accept = v
-	}
-	if v, ok := header["Accept-Encoding"]; ok {
-		oe.HttpHeader_Accept_Encoding = v
-	}
-	if v, ok := header["Accept-Language"]; ok {
-		oe.HttpHeader_Accept_Language = v
-	}
-	if v, ok := header["Accept-Cache-Control"]; ok {
-		oe.HttpHeader_Cache_Control = v
-	}
-	if v, ok := header["Connection"]; ok {
-		oe.HttpHeader_Connection = v
-	}
-	if v, ok := header["Host"]; ok {
-		oe.HttpHeader_Host = v
-	}
-	if v, ok := header["Metadata-Flavor"]; ok {
-		oe.HttpHeader_Metadata_Flavor = v
-	}
-	if v, ok := header["Pragma"]; ok {
-		oe.HttpHeader_Pragma = v
-	}
-	if v, ok := header["Referer"]; ok {
-		oe.HttpHeader_Referer = v
-	}
-	if v, ok := header["Upgrade-Insecure-Requests"]; ok {
-		oe.HttpHeader_Upgrade_Insecure_Requests = v
-	}
-	if v, ok := header["User-Agent"]; ok {
-		oe.HttpHeader_User_Agent = v
+	if len(header) > 0 && oe.HttpHeader == nil {
+		oe.HttpHeader = make(map[string]string, len(header))
 	}
-	if v, ok := header["Content-Length"]; ok {
-		oe.HttpHeader_Content_Length = v
-	}
-	if v, ok := header["Content-Type"]; ok {
-		oe.HttpHeader_Content_Type = v
-	}
-	if v, ok := header["Date"]; ok {
-		oe.HttpHeader_Date = v
-	}
-	if v, ok := header["ETag"]; ok {
-		oe.HttpHeader_ETag = v
-	}
-	if v, ok := header["Server"]; ok {
-		oe.HttpHeader_Server = v
+	for k, v := range header {
+		if !f.WriteCredentialHeaders {
+			v = RedactHeader(k, v)
+		}
+		oe.HttpHeader[k] = v
 	}
-	if v, ok := header["X-Frame-Options"]; ok {
-		oe.HttpHeader_X_Frame_Options = v
+}
+
+// Returns a header value with any credential removed.
+func RedactHeader(name, value string) string {
+
+	name = strings.ToLower(name)
+	if !credentialHeaders[name] {
+		return value
 	}
-	if v, ok := header["X-XSS-Protection"]; ok {
-		oe.HttpHeader_X_XSS_Protection = v
+
+	if strings.HasSuffix(name, "authorization") {
+		if i := strings.IndexByte(value, ' '); i > 0 {
+			return value[:i] + " " + redactedHeader
+		}
 	}
+
+	return redactedHeader
+
 }
 
 // Flatten an HTTP request
 func (f *Flattener) FlattenHttpRequest(e *dt.Event, oe *FlatEvent) {
 	oe.HttpRequestMethod = e.HttpRequest.Method
-	if f.WritePayloads {
-		oe.HttpBody = Debase64(e.HttpRequest.Body)
+	if f.WriteHttpBody {
+		var n int
+		oe.HttpBody, n, oe.HttpBodySha1 =
+			f.Payload(e.HttpRequest.Body, "", oe)
+		oe.HttpBodyLength = int64(n)
 	}
 	f.FlattenHttpHeader(e.HttpRequest.Header, oe)
 }
@@ -338,8 +514,11 @@ func (f *Flattener) FlattenHttpRequest(e *dt.Event, oe *FlatEvent) {
 func (f *Flattener) FlattenHttpResponse(e *dt.Event, oe *FlatEvent) {
 	oe.HttpResponseStatus = e.HttpResponse.Status
 	oe.HttpResponseCode = int32(e.HttpResponse.Code)
-	if f.WritePayloads {
-		oe.HttpBody = Debase64(e.HttpRequest.Body)
+	if f.WriteHttpBody {
+		var n int
+		oe.HttpBody, n, oe.HttpBodySha1 =
+			f.Payload(e.HttpResponse.Body, "", oe)
+		oe.HttpBodyLength = int64(n)
 	}
 	f.FlattenHttpHeader(e.HttpResponse.Header, oe)
 }
@@ -348,8 +527,11 @@ func (f *Flattener) FlattenHttpResponse(e *dt.Event, oe *FlatEvent) {
 func (f *Flattener) FlattenIcmp(e *dt.Event, oe *FlatEvent) {
 	oe.IcmpCode = int32(e.Icmp.Code)
 	oe.IcmpType = int32(e.Icmp.Type)
-	if f.WritePayloads {
-		oe.IcmpPayload = Debase64(e.Icmp.Payload)
+	if f.WriteIcmpPayload {
+		var n int
+		oe.IcmpPayload, n, oe.IcmpPayloadSha1 =
+			f.Payload(e.Icmp.Payload, "", oe)
+		oe.IcmpPayloadLength = int64(n)
 	}
 }
 
@@ -396,30 +578,38 @@ func (f *Flattener) FlattenNtpTimestamp(e *dt.Event, oe *FlatEvent) {
 // Flatten unrecognised datagram information
 func (f *Flattener) FlattenUnrecognisedDatagram(e *dt.Event, oe *FlatEvent) {
 
-	if f.WritePayloads {
-		oe.UnrecognisedDatagramPayload =
-			Debase64(e.UnrecognisedDatagram.Payload)
-	}
 	oe.UnrecognisedDatagramPayloadLength =
 		int64(e.UnrecognisedDatagram.PayloadLength)
 	oe.UnrecognisedDatagramPayloadSha1 = e.UnrecognisedDatagram.PayloadHash
 
+	// The payload is stored under the hash Payload returns, which is
+	// its own if the event's isn't a valid SHA-1.
+	if f.WriteDatagramPayload {
+		oe.UnrecognisedDatagramPayload, _,
+			oe.UnrecognisedDatagramPayloadSha1 =
+			f.Payload(e.UnrecognisedDatagram.Payload,
+				e.UnrecognisedDatagram.PayloadHash, oe)
+	}
+
 }
 
 // Flatten an unrecognised stream
 func (f *Flattener) FlattenUnrecognisedStream(e *dt.Event, oe *FlatEvent) {
 
-	if f.WritePayloads {
-		oe.UnrecognisedStreamPayload =
-			Debase64(e.UnrecognisedStream.Payload)
-	}
 	oe.UnrecognisedStreamPayloadLength =
 		int64(e.UnrecognisedStream.PayloadLength)
 	oe.UnrecognisedStreamPayloadSha1 = e.UnrecognisedStream.PayloadHash
 
+	if f.WriteStreamPayload {
+		oe.UnrecognisedStreamPayload, _,
+			oe.UnrecognisedStreamPayloadSha1 =
+			f.Payload(e.UnrecognisedStream.Payload,
+				e.UnrecognisedStream.PayloadHash, oe)
+	}
+
 }
 
-// Flatten DNS information
+// Flatten indicators
 func (f *Flattener) FlattenIndicators(e *dt.Event, oe *FlatEvent) {
 	if e.Indicators != nil {
 		if len(*e.Indicators) >= 1 {
@@ -452,6 +642,18 @@ func (f *Flattener) FlattenIndicators(e *dt.Event, oe *FlatEvent) {
 			oe.IndicatorAuthor2 = ind.Author
 			oe.IndicatorSource2 = ind.Source
 		}
+		for _, ind := range *e.Indicators {
+			oe.Indicators = append(oe.Indicators, FlatIndicator{
+				Id:          ind.Id,
+				Type:        ind.Type,
+				Value:       ind.Value,
+				Description: ind.Description,
+				Category:    ind.Category,
+				Author:      ind.Author,
+				Source:      ind.Source,
+			})
+		}
+		oe.IndicatorCount = int32(len(*e.Indicators))
 	}
 }
 
@@ -469,10 +671,22 @@ func (f *Flattener) FlattenEvent(e *dt.Event) *FlatEvent {
 		Origin:  e.Origin,
 	}
 
-	tm, _ := time.Parse("2006-01-02T15:04:05.000Z", e.Time)
+	tm, err := ParseTime(e.Time)
+	if err != nil {
+		oe.TimeParseError = true
+		if f.ReceiveTimeFallback {
+			tm = time.Now()
+		} else {
+			tm = time.Unix(0, 0)
+		}
+	}
+
 	nanos := tm.UnixNano()
 	oe.TimeMicros = nanos / 1000
 	oe.TimeMins = int32(nanos / 1000000000 / 60)
+	oe.EventTimeMillis = nanos / 1000000
+	oe.EventTimeMicros = nanos / 1000
+	oe.EventTimeInt96 = Int96Time(tm)
 
 	f.FlattenSrc(e, oe)
 	f.FlattenDest(e, oe)
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+)
+
+// Golden cyberprobe events, one or more for each action type, and the
+// FlatEvent fields they should produce.  Only fields set in want are
+// compared.
+var flattenTests = []struct {
+	name  string
+	event string
+	want  FlatEvent
+}{
+	{
+		name: "connection_up",
+		event: `{"id":"c1","action":"connection_up","device":"dev1",
+			"network":"net1","origin":"network",
+			"time":"2018-06-01T12:00:00.123Z",
+			"src":["ipv4:10.0.0.1","tcp:51234"],
+			"dest":["ipv4:192.168.1.1","tcp:443"]}`,
+		want: FlatEvent{
+			Id: "c1", Action: "connection_up", Device: "dev1",
+			Network: "net1", Origin: "network",
+			Time:            "2018-06-01T12:00:00.123Z",
+			TimeMins:        25464240,
+			TimeMicros:      1527854400123000,
+			EventTimeMillis: 1527854400123,
+			EventTimeMicros: 1527854400123000,
+			EventTimeInt96:  int96(2458271, 43200123000000),
+			Src:             []string{"ipv4:10.0.0.1", "tcp:51234"},
+			Dest:            []string{"ipv4:192.168.1.1", "tcp:443"},
+			SrcIpv4:         "10.0.0.1", SrcTcp: 51234,
+			DestIpv4: "192.168.1.1", DestTcp: 443,
+			SrcIpv4Int:  int64p(0x0a000001),
+			DestIpv4Int: int64p(0xc0a80101),
+		},
+	},
+	{
+		name: "connection_down",
+		event: `{"id":"c2","action":"connection_down",
+			"time":"2018-06-01T12:00:00Z",
+			"src":["ipv6:2001:db8::1","tcp:51234"],
+			"dest":["ipv6:2001:db8::2","tcp:80"]}`,
+		want: FlatEvent{
+			Action:          "connection_down",
+			EventTimeMillis: 1527854400000,
+			EventTimeMicros: 1527854400000000,
+			EventTimeInt96:  int96(2458271, 43200000000000),
+			SrcIpv6:         "2001:db8::1", SrcTcp: 51234,
+			DestIpv6: "2001:db8::2", DestTcp: 80,
+			SrcIpv6Bytes: stringp("\x20\x01\x0d\xb8" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"),
+		},
+	},
+	{
+		name: "unrecognised_datagram",
+		event: `{"id":"u1","action":"unrecognised_datagram",
+			"time":"2018-06-01T12:00:00Z",
+			"src":["ipv4:10.0.0.1","udp:5000"],
+			"dest":["ipv4:10.0.0.2","udp:6000"],
+			"unrecognised_datagram":{"payload":"aGVsbG8=",
+				"payload_length":5,
+				"payload_hash":"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"}}`,
+		want: FlatEvent{
+			Action: "unrecognised_datagram",
+			SrcUdp: 5000, DestUdp: 6000,
+			UnrecognisedDatagramPayload:       "hello",
+			UnrecognisedDatagramPayloadLength: 5,
+			UnrecognisedDatagramPayloadSha1:   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		},
+	},
+	{
+		name: "unrecognised_stream",
+		event: `{"id":"u2","action":"unrecognised_stream",
+			"time":"2018-06-01T12:00:00Z",
+			"unrecognised_stream":{"payload":"aGVsbG8=",
+				"payload_length":5,
+				"payload_hash":"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"}}`,
+		want: FlatEvent{
+			Action:                          "unrecognised_stream",
+			UnrecognisedStreamPayload:       "hello",
+			UnrecognisedStreamPayloadLength: 5,
+			UnrecognisedStreamPayloadSha1:   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		},
+	},
+	{
+		name: "icmp",
+		event: `{"id":"i1","action":"icmp","time":"2018-06-01T12:00:00Z",
+			"icmp":{"type":8,"code":0,"payload":"cGluZ2RhdGE="}}`,
+		want: FlatEvent{
+			Action: "icmp", IcmpType: 8,
+			IcmpPayload:       "pingdata",
+			IcmpPayloadLength: 8,
+			IcmpPayloadSha1:   "fab7e63c3d0ccd7f5fee2a0eaee161cb2a60157b",
+		},
+	},
+	{
+		name: "http_request",
+		event: `{"id":"h1","action":"http_request",
+			"time":"2018-06-01T12:00:00Z",
+			"url":"http://example.com/",
+			"http_request":{"method":"GET",
+				"header":{"Host":"example.com","User-Agent":"curl"},
+				"body":"aGVsbG8="}}`,
+		want: FlatEvent{
+			Action: "http_request", Url: "http://example.com/",
+			HttpRequestMethod: "GET",
+			HttpHeader: map[string]string{"Host": "example.com",
+				"User-Agent": "curl"},
+			HttpBody:       "hello",
+			HttpBodyLength: 5,
+			HttpBodySha1:   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		},
+	},
+	{
+		// Used to panic, the body was taken from the (absent) request.
+		name: "http_response",
+		event: `{"id":"h2","action":"http_response",
+			"time":"2018-06-01T12:00:00Z",
+			"http_response":{"code":200,"status":"OK",
+				"header":{"cache-control":"no-cache",
+					"Content-Type":"text/html"},
+				"body":"PGh0bWw+"}}`,
+		want: FlatEvent{
+			Action: "http_response", HttpResponseCode: 200,
+			HttpResponseStatus: "OK",
+			HttpHeader: map[string]string{"cache-control": "no-cache",
+				"Content-Type": "text/html"},
+			HttpBody:       "<html>",
+			HttpBodyLength: 6,
+			HttpBodySha1:   "0fe0bb445f51fad57f3fc4115d7c66cf18545107",
+		},
+	},
+	{
+		name: "dns_message",
+		event: `{"id":"d1","action":"dns_message",
+			"time":"2018-06-01T12:00:00Z",
+			"dns_message":{"type":"response",
+				"query":[{"name":"example.com","type":"A","class":"IN"}],
+				"answer":[
+					{"name":"example.com","type":"A","class":"IN",
+						"address":"93.184.216.34"},
+					{"name":"example.com","type":"A","class":"IN",
+						"address":"93.184.216.35"}]}}`,
+		want: FlatEvent{
+			Action:                   "dns_message",
+			DnsMessageType:           "response",
+			DnsMessageQueryName0:     "example.com",
+			DnsMessageQueryType0:     "A",
+			DnsMessageQueryClass0:    "IN",
+			DnsMessageAnswerName0:    "example.com",
+			DnsMessageAnswerAddress0: "93.184.216.34",
+			DnsMessageAnswerName1:    "example.com",
+			DnsMessageAnswerAddress1: "93.184.216.35",
+			DnsMessageQuery: []FlatDnsQuery{
+				{Name: "example.com", Type: "A", Class: "IN"},
+			},
+			DnsMessageAnswer: []FlatDnsAnswer{
+				{Name: "example.com", Type: "A", Class: "IN",
+					Address: "93.184.216.34"},
+				{Name: "example.com", Type: "A", Class: "IN",
+					Address: "93.184.216.35"},
+			},
+		},
+	},
+	{
+		name: "ntp_timestamp",
+		event: `{"id":"n1","action":"ntp_timestamp",
+			"time":"2018-06-01T12:00:00Z",
+			"ntp_timestamp":{"mode":3,"version":4}}`,
+		want: FlatEvent{
+			Action:           "ntp_timestamp",
+			NtpTimestampMode: 3, NtpTimestampVersion: 4,
+		},
+	},
+	{
+		name: "ntp_control",
+		event: `{"id":"n2","action":"ntp_control",
+			"time":"2018-06-01T12:00:00Z",
+			"src":["ipv4:10.0.0.1","udp:123"]}`,
+		want: FlatEvent{Action: "ntp_control", SrcUdp: 123},
+	},
+	{
+		name: "ntp_private",
+		event: `{"id":"n3","action":"ntp_private",
+			"time":"2018-06-01T12:00:00Z",
+			"src":["ipv4:10.0.0.1","udp:123"]}`,
+		want: FlatEvent{Action: "ntp_private", SrcUdp: 123},
+	},
+	{
+		name: "ftp_command",
+		event: `{"id":"f1","action":"ftp_command",
+			"time":"2018-06-01T12:00:00Z",
+			"dest":["ipv4:10.0.0.2","tcp:21"],
+			"ftp_command":{"command":"USER anonymous"}}`,
+		want: FlatEvent{Action: "ftp_command", DestTcp: 21},
+	},
+	{
+		name: "ftp_response",
+		event: `{"id":"f2","action":"ftp_response",
+			"time":"2018-06-01T12:00:00Z",
+			"src":["ipv4:10.0.0.2","tcp:21"],
+			"ftp_response":{"status":230,"text":["Logged in"]}}`,
+		want: FlatEvent{Action: "ftp_response", SrcTcp: 21},
+	},
+	{
+		name: "smtp_command",
+		event: `{"id":"s1","action":"smtp_command",
+			"time":"2018-06-01T12:00:00Z",
+			"dest":["ipv4:10.0.0.2","tcp:25"],
+			"smtp_command":{"command":"EHLO example.com"}}`,
+		want: FlatEvent{Action: "smtp_command", DestTcp: 25},
+	},
+	{
+		name: "smtp_response",
+		event: `{"id":"s2","action":"smtp_response",
+			"time":"2018-06-01T12:00:00Z",
+			"smtp_response":{"status":250,"text":["OK"]}}`,
+		want: FlatEvent{Action: "smtp_response"},
+	},
+	{
+		name: "smtp_data",
+		event: `{"id":"s3","action":"smtp_data",
+			"time":"2018-06-01T12:00:00Z",
+			"smtp_data":{"from":"a@example.com",
+				"to":["b@example.com"],"data":"aGVsbG8="}}`,
+		want: FlatEvent{Action: "smtp_data"},
+	},
+	{
+		name: "sip_request",
+		event: `{"id":"p1","action":"sip_request",
+			"time":"2018-06-01T12:00:00Z",
+			"dest":["ipv4:10.0.0.2","udp:5060"],
+			"sip_request":{"method":"INVITE",
+				"from":"sip:a@example.com","to":"sip:b@example.com"}}`,
+		want: FlatEvent{Action: "sip_request", DestUdp: 5060},
+	},
+	{
+		name: "sip_response",
+		event: `{"id":"p2","action":"sip_response",
+			"time":"2018-06-01T12:00:00Z",
+			"sip_response":{"code":200,"status":"OK"}}`,
+		want: FlatEvent{Action: "sip_response"},
+	},
+	{
+		name: "sip_ssl",
+		event: `{"id":"p3","action":"sip_ssl",
+			"time":"2018-06-01T12:00:00Z",
+			"dest":["ipv4:10.0.0.2","tcp:5061"]}`,
+		want: FlatEvent{Action: "sip_ssl", DestTcp: 5061},
+	},
+	{
+		name: "imap",
+		event: `{"id":"m1","action":"imap","time":"2018-06-01T12:00:00Z",
+			"dest":["ipv4:10.0.0.2","tcp:143"]}`,
+		want: FlatEvent{Action: "imap", DestTcp: 143},
+	},
+	{
+		name: "imap_ssl",
+		event: `{"id":"m2","action":"imap_ssl",
+			"time":"2018-06-01T12:00:00Z",
+			"dest":["ipv4:10.0.0.2","tcp:993"]}`,
+		want: FlatEvent{Action: "imap_ssl", DestTcp: 993},
+	},
+	{
+		name: "pop3",
+		event: `{"id":"m3","action":"pop3","time":"2018-06-01T12:00:00Z",
+			"dest":["ipv4:10.0.0.2","tcp:110"]}`,
+		want: FlatEvent{Action: "pop3", DestTcp: 110},
+	},
+	{
+		name: "pop3_ssl",
+		event: `{"id":"m4","action":"pop3_ssl",
+			"time":"2018-06-01T12:00:00Z",
+			"dest":["ipv4:10.0.0.2","tcp:995"]}`,
+		want: FlatEvent{Action: "pop3_ssl", DestTcp: 995},
+	},
+	{
+		name: "location and indicators",
+		event: `{"id":"l1","action":"http_request",
+			"time":"2018-06-01T12:00:00Z","risk":0.5,
+			"http_request":{"method":"GET"},
+			"location":{
+				"src":{"city":"London","iso":"GB",
+					"country":"United Kingdom","accuracy":50,
+					"postcode":"EC1","asnum":64512,"asorg":"Example",
+					"position":{"latitude":51.5,"longitude":-0.1}},
+				"dest":{"country":"United States","iso":"US"}},
+			"indicators":[
+				{"id":"ind1","type":"hostname","value":"bad.example.com",
+					"description":"Bad host","category":"malware",
+					"author":"someone","source":"feed"},
+				{"id":"ind2","type":"ipv4","value":"10.0.0.2"}]}`,
+		want: FlatEvent{
+			Risk:                   0.5,
+			LocationSrcCity:        "London",
+			LocationSrcIso:         "GB",
+			LocationSrcCountry:     "United Kingdom",
+			LocationSrcAccuracy:    50,
+			LocationSrcPostCode:    "EC1",
+			LocationSrcAsnum:       64512,
+			LocationSrcAsorg:       "Example",
+			LocationSrcPositionLat: 51.5,
+			LocationSrcPositionLon: -0.1,
+			LocationDestCountry:    "United States",
+			LocationDestIso:        "US",
+			IndicatorId0:           "ind1",
+			IndicatorType0:         "hostname",
+			IndicatorValue0:        "bad.example.com",
+			IndicatorDescription0:  "Bad host",
+			IndicatorCategory0:     "malware",
+			IndicatorAuthor0:       "someone",
+			IndicatorSource0:       "feed",
+			IndicatorId1:           "ind2",
+			IndicatorValue1:        "10.0.0.2",
+			IndicatorCount:         2,
+			Indicators: []FlatIndicator{
+				{Id: "ind1", Type: "hostname", Value: "bad.example.com",
+					Description: "Bad host", Category: "malware",
+					Author: "someone", Source: "feed"},
+				{Id: "ind2", Type: "ipv4", Value: "10.0.0.2"},
+			},
+		},
+	},
+	{
+		name: "unparseable time",
+		event: `{"id":"t1","action":"connection_up",
+			"time":"yesterday"}`,
+		want: FlatEvent{Time: "yesterday", TimeParseError: true},
+	},
+}
+
+func int64p(v int64) *int64    { return &v }
+func stringp(v string) *string { return &v }
+
+// An INT96 timestamp built by hand: nanoseconds into the day, then the
+// Julian day, little-endian.
+func int96(day uint32, nanos uint64) string {
+	b := make([]byte, 12)
+	for i := 0; i < 8; i++ {
+		b[i] = byte(nanos >> uint(8*i))
+	}
+	for i := 0; i < 4; i++ {
+		b[8+i] = byte(day >> uint(8*i))
+	}
+	return string(b)
+}
+
+func TestInt96Time(t *testing.T) {
+
+	tests := []struct {
+		time  string
+		day   uint32
+		nanos uint64
+	}{
+		{"1970-01-01T00:00:00Z", 2440588, 0},
+		{"1970-01-02T00:00:00Z", 2440589, 0},
+		{"1969-12-31T00:00:00Z", 2440587, 0},
+		{"1969-12-31T23:59:59.5Z", 2440587, 86399500000000},
+		{"2018-06-01T12:00:00.123456789Z", 2458271, 43200123456789},
+		{"2018-06-01T23:59:59.999999999Z", 2458271, 86399999999999},
+	}
+
+	for _, tt := range tests {
+		tm, err := time.Parse(time.RFC3339Nano, tt.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := Int96Time(tm)
+		want := int96(tt.day, tt.nanos)
+		if got != want {
+			t.Errorf("%s: got % x, want % x", tt.time, got, want)
+		}
+	}
+
+}
+
+func TestFlattenEvent(t *testing.T) {
+
+	f := Flattener{
+		WriteHttpBody:        true,
+		WriteIcmpPayload:     true,
+		WriteDatagramPayload: true,
+		WriteStreamPayload:   true,
+	}
+
+	for _, tt := range flattenTests {
+
+		var e dt.Event
+		err := json.Unmarshal([]byte(tt.event), &e)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err.Error())
+		}
+
+		got := reflect.ValueOf(*f.FlattenEvent(&e))
+		want := reflect.ValueOf(tt.want)
+
+		for i := 0; i < want.NumField(); i++ {
+			w := want.Field(i)
+			if reflect.DeepEqual(w.Interface(),
+				reflect.Zero(w.Type()).Interface()) {
+				continue
+			}
+			g := got.Field(i)
+			if !reflect.DeepEqual(g.Interface(), w.Interface()) {
+				t.Errorf("%s: %s = %#v, want %#v", tt.name,
+					want.Type().Field(i).Name, g.Interface(),
+					w.Interface())
+			}
+		}
+
+	}
+
+}
+
+// The promoted Cache-Control column is found whatever the header's case.
+func TestPromotedHeaderColumn(t *testing.T) {
+
+	schema, err := NewSchema(func(f reflect.StructField) bool {
+		return f.Name != "Id"
+	}, []string{"Cache-Control"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oe := &FlatEvent{
+		HttpHeader: map[string]string{"cache-control": "no-cache"},
+	}
+
+	row := reflect.ValueOf(schema.Row(oe))
+	got := row.FieldByName("HttpHeader_Cache_Control").String()
+	if got != "no-cache" {
+		t.Errorf("http_header_Cache_Control = %q, want no-cache", got)
+	}
+
+}
+
+func TestRedactHeader(t *testing.T) {
+
+	tests := []struct {
+		name, value, want string
+	}{
+		{"Authorization", "Bearer abc.def.ghi", "Bearer REDACTED"},
+		{"authorization", "Basic dXNlcjpwYXNz", "Basic REDACTED"},
+		{"Proxy-Authorization", "Negotiate YIIabc", "Negotiate REDACTED"},
+		{"Authorization", "token", "REDACTED"},
+		{"Cookie", "session=abc123; theme=dark", "REDACTED"},
+		{"Set-Cookie", "session=abc123; HttpOnly", "REDACTED"},
+		{"Host", "example.com", "example.com"},
+		{"X-Forwarded-For", "10.0.0.1", "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		got := RedactHeader(tt.name, tt.value)
+		if got != tt.want {
+			t.Errorf("RedactHeader(%q, %q) = %q, want %q", tt.name,
+				tt.value, got, tt.want)
+		}
+	}
+
+}
+
+func TestFlattenHttpHeaderRedacts(t *testing.T) {
+
+	header := map[string]string{
+		"Authorization": "Bearer secret",
+		"Cookie":        "session=secret",
+		"Accept":        "*/*",
+	}
+
+	var f Flattener
+	oe := &FlatEvent{}
+	f.FlattenHttpHeader(header, oe)
+
+	if oe.HttpHeader["Authorization"] != "Bearer REDACTED" ||
+		oe.HttpHeader["Cookie"] != "REDACTED" ||
+		oe.HttpHeader["Accept"] != "*/*" {
+		t.Errorf("headers not redacted: %v", oe.HttpHeader)
+	}
+
+	// Opted in, written as they are.
+	f.WriteCredentialHeaders = true
+	oe = &FlatEvent{}
+	f.FlattenHttpHeader(header, oe)
+
+	if oe.HttpHeader["Authorization"] != "Bearer secret" ||
+		oe.HttpHeader["Cookie"] != "session=secret" {
+		t.Errorf("headers redacted: %v", oe.HttpHeader)
+	}
+
+}
+
+// Records payloads put in the store.
+type testPayloadStore map[string]string
+
+func (ps testPayloadStore) Put(hash string, payload []byte) {
+	ps[hash] = string(payload)
+}
+
+// The sha1 column must name the object the payload was stored under, even
+// when the event's own hash is missing or not a SHA-1.
+func TestSidecarPayloadHash(t *testing.T) {
+
+	const sha1 = "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+
+	for _, hash := range []string{"", "not-a-hash", sha1} {
+
+		store := testPayloadStore{}
+		f := Flattener{
+			WriteDatagramPayload: true,
+			WriteStreamPayload:   true,
+			Payloads:             store,
+		}
+
+		for _, action := range []string{"unrecognised_datagram",
+			"unrecognised_stream"} {
+
+			var e dt.Event
+			err := json.Unmarshal([]byte(`{"action":"`+action+`",`+
+				`"`+action+`":{"payload":"aGVsbG8=",`+
+				`"payload_length":5,"payload_hash":"`+hash+`"}}`), &e)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			oe := f.FlattenEvent(&e)
+
+			got := oe.UnrecognisedDatagramPayloadSha1
+			if action == "unrecognised_stream" {
+				got = oe.UnrecognisedStreamPayloadSha1
+			}
+			if got != sha1 || store[got] != "hello" {
+				t.Errorf("%s, hash %q: column %q, store %v", action,
+					hash, got, store)
+			}
+
+		}
+
+	}
+
+}
@@ -0,0 +1,158 @@
+package main
+
+// HDFS storage.  Objects are written under a root directory with the same
+// path layout as the buckets, under a hidden temporary name which is renamed
+// into place once the object is complete.
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/colinmarc/hdfs"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// The parts of the HDFS client used, so that the filesystem stand-in can
+// replace it.
+type hdfsClient interface {
+	Create(name string) (io.WriteCloser, error)
+	MkdirAll(name string, perm os.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+}
+
+type hdfsStorage struct {
+	client hdfsClient
+	root   string
+}
+
+// HDFS_NAMENODE is a comma separated list of namenode addresses.  A
+// file:// URL instead uses a local directory as a stand-in for HDFS, to
+// exercise this backend without a cluster.
+func newHdfsStorage() (*hdfsStorage, error) {
+
+	namenode := utils.Getenv("HDFS_NAMENODE", "namenode:8020")
+	root := path.Clean("/" + utils.Getenv("STORAGE_ROOT", "/parquetstorage"))
+
+	var client hdfsClient
+
+	if strings.HasPrefix(namenode, "file://") {
+		dir := strings.TrimPrefix(namenode, "file://")
+		utils.Log("Using %s as a stand-in for HDFS", dir)
+		client = hdfsStandIn(dir)
+	} else {
+		c, err := hdfs.NewClient(hdfs.ClientOptions{
+			Addresses: strings.Split(namenode, ","),
+			User:      utils.Getenv("HDFS_USER", "hdfs"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		client = hdfsClientAdapter{c}
+	}
+
+	err := client.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	utils.Log("Storing objects under hdfs://%s%s", namenode, root)
+
+	return &hdfsStorage{client: client, root: root}, nil
+
+}
+
+func (h *hdfsStorage) Upload(path string, data []byte) error {
+	return uploadTo(h.Create, path, data)
+}
+
+func (h *hdfsStorage) Create(name string) (Sink, error) {
+
+	file := path.Join(h.root, name)
+	dir, base := path.Split(file)
+	tmp := path.Join(dir, "."+base+tmpSuffix)
+
+	err := h.client.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := h.client.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hdfsSink{client: h.client, w: w, file: file, tmp: tmp}, nil
+
+}
+
+type hdfsSink struct {
+	client hdfsClient
+	w      io.WriteCloser
+	file   string
+	tmp    string
+}
+
+func (s *hdfsSink) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+// Closing the writer waits for the datanodes to acknowledge the last
+// block.
+func (s *hdfsSink) Close() error {
+
+	err := s.w.Close()
+	if err != nil {
+		s.client.Remove(s.tmp)
+		return err
+	}
+
+	err = s.client.Rename(s.tmp, s.file)
+	if err != nil {
+		s.client.Remove(s.tmp)
+		return err
+	}
+
+	return nil
+
+}
+
+func (s *hdfsSink) Abort() error {
+	s.w.Close()
+	return s.client.Remove(s.tmp)
+}
+
+// hdfs.Client.Create returns a concrete type.
+type hdfsClientAdapter struct {
+	*hdfs.Client
+}
+
+func (c hdfsClientAdapter) Create(name string) (io.WriteCloser, error) {
+	return c.Client.Create(name)
+}
+
+// Local directory standing in for HDFS.
+type hdfsStandIn string
+
+func (d hdfsStandIn) file(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(name))
+}
+
+func (d hdfsStandIn) Create(name string) (io.WriteCloser, error) {
+	return os.Create(d.file(name))
+}
+
+func (d hdfsStandIn) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(d.file(name), perm)
+}
+
+func (d hdfsStandIn) Rename(oldpath, newpath string) error {
+	return os.Rename(d.file(oldpath), d.file(newpath))
+}
+
+func (d hdfsStandIn) Remove(name string) error {
+	return os.Remove(d.file(name))
+}
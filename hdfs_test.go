@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns HDFS storage on a stand-in directory, and that directory.
+func newTestHdfs(t *testing.T) (*hdfsStorage, string) {
+
+	dir, err := ioutil.TempDir("", "hdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("HDFS_NAMENODE", "file://"+dir)
+	os.Setenv("STORAGE_ROOT", "parquet")
+	defer os.Unsetenv("HDFS_NAMENODE")
+	defer os.Unsetenv("STORAGE_ROOT")
+
+	h, err := newHdfsStorage()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return h, dir
+
+}
+
+func exists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+func TestHdfsUpload(t *testing.T) {
+
+	h, dir := newTestHdfs(t)
+	defer os.RemoveAll(dir)
+
+	err := h.Upload("a/b/object.parquet", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "parquet", "a", "b", "object.parquet")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" {
+		t.Errorf("stored %q", data)
+	}
+
+	tmp := filepath.Join(dir, "parquet", "a", "b", ".object.parquet.tmp")
+	if exists(tmp) {
+		t.Errorf("%s left behind", tmp)
+	}
+
+}
+
+func TestHdfsAbort(t *testing.T) {
+
+	h, dir := newTestHdfs(t)
+	defer os.RemoveAll(dir)
+
+	sink, err := h.Create("a/object.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := filepath.Join(dir, "parquet", "a", ".object.parquet.tmp")
+	if !exists(tmp) {
+		t.Fatalf("%s not created", tmp)
+	}
+
+	_, err = sink.Write([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sink.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(tmp) {
+		t.Errorf("%s left behind", tmp)
+	}
+	if exists(filepath.Join(dir, "parquet", "a", "object.parquet")) {
+		t.Error("aborted object stored")
+	}
+
+}
+
+// A failed rename must not leave the temporary file behind.
+func TestHdfsCloseFailure(t *testing.T) {
+
+	h, dir := newTestHdfs(t)
+	defer os.RemoveAll(dir)
+
+	// A non-empty directory in the way makes the rename fail.
+	file := filepath.Join(dir, "parquet", "a", "object.parquet")
+	err := os.MkdirAll(filepath.Join(file, "x"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err := h.Create("a/object.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sink.Write([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sink.Close()
+	if err == nil {
+		t.Fatal("Close succeeded with a directory in the way")
+	}
+
+	tmp := filepath.Join(dir, "parquet", "a", ".object.parquet.tmp")
+	if exists(tmp) {
+		t.Errorf("%s left behind", tmp)
+	}
+
+}
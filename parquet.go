@@ -3,66 +3,164 @@ package main
 // Parquet file writer.
 
 import (
-	"io"	
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/trustnetworks/analytics-common/utils"
 	"github.com/xitongsys/parquet-go/ParquetFile"
 	"github.com/xitongsys/parquet-go/ParquetWriter"
 	"github.com/xitongsys/parquet-go/parquet"
 )
 
 type Writer struct {
-	f  ParquetFile.ParquetFile
-	pw *ParquetWriter.ParquetWriter
+	f    ParquetFile.ParquetFile
+	pw   *ParquetWriter.ParquetWriter
+	sink Sink
+}
+
+// Writer tuning, set from the environment by setWriterOptions.
+type WriterOptions struct {
+	Compression  parquet.CompressionCodec
+	RowGroupSize int64
+	PageSize     int64
+	Parallelism  int64 // Marshalling goroutines
 }
 
-func NewWriter(writer io.Writer) (*Writer, error) {
+var writerOptions = WriterOptions{
+	Compression:  parquet.CompressionCodec_SNAPPY,
+	RowGroupSize: 128 * 1024 * 1024, // 128M
+	PageSize:     8 * 1024,          // 8K
+	Parallelism:  4,
+}
+
+// More marshalling goroutines than this is surely a mistake.
+const maxParallelism = 256
+
+// Codecs the parquet-go compressor handles.  LZ4 and ZSTD are valid Parquet
+// codecs, but not ones this version of parquet-go can write.
+var supportedCompression = map[parquet.CompressionCodec]bool{
+	parquet.CompressionCodec_UNCOMPRESSED: true,
+	parquet.CompressionCodec_SNAPPY:       true,
+	parquet.CompressionCodec_GZIP:         true,
+}
 
-	pf := ParquetFile.NewWriterFile(writer)
+// Reads PARQUET_COMPRESSION, PARQUET_ROW_GROUP_SIZE, PARQUET_PAGE_SIZE and
+// PARQUET_PARALLELISM.  Unlike most settings a bad value is an error rather
+// than falling back to the default, as it's usually a benchmarking run
+// which sets them.
+func setWriterOptions() error {
 
-	// 4 writer goroutines.
-	pw, err := ParquetWriter.NewParquetWriter(pf, new(FlatEvent), 4)
+	comp := strings.ToUpper(strings.TrimSpace(
+		utils.Getenv("PARQUET_COMPRESSION", "SNAPPY")))
+	codec, err := parquet.CompressionCodecFromString(comp)
 	if err != nil {
-		pf.Close()
-		return nil, err
+		return fmt.Errorf("PARQUET_COMPRESSION: unknown codec %s", comp)
+	}
+	if !supportedCompression[codec] {
+		return fmt.Errorf("PARQUET_COMPRESSION: %s not supported", comp)
+	}
+	writerOptions.Compression = codec
+
+	sizes := []struct {
+		env string
+		val *int64
+		def string
+	}{
+		{"PARQUET_ROW_GROUP_SIZE", &writerOptions.RowGroupSize, "128M"},
+		{"PARQUET_PAGE_SIZE", &writerOptions.PageSize, "8K"},
+	}
+	for _, sz := range sizes {
+		v := utils.Getenv(sz.env, sz.def)
+		*sz.val, err = parseSize(v)
+		if err != nil || *sz.val < 1 {
+			return fmt.Errorf("%s: invalid value %s", sz.env, v)
+		}
 	}
-	pw.RowGroupSize = 128 * 1024 * 1024 // 128M
-	pw.CompressionType = parquet.CompressionCodec_SNAPPY
 
-	w := &Writer{f: pf, pw: pw}
+	// A count of goroutines, not a size.
+	par := utils.Getenv("PARQUET_PARALLELISM", "4")
+	writerOptions.Parallelism, err = strconv.ParseInt(strings.TrimSpace(
+		strings.Replace(par, "\"", "", -1)), 10, 64)
+	if err != nil || writerOptions.Parallelism < 1 ||
+		writerOptions.Parallelism > maxParallelism {
+		return fmt.Errorf("PARQUET_PARALLELISM: invalid value %s", par)
+	}
 
-	return w, nil
+	if writerOptions.PageSize > writerOptions.RowGroupSize {
+		return fmt.Errorf("PARQUET_PAGE_SIZE is larger than " +
+			"PARQUET_ROW_GROUP_SIZE")
+	}
+
+	utils.Log("writerOptions set to: compression=%v rowGroupSize=%v "+
+		"pageSize=%v parallelism=%v", writerOptions.Compression,
+		writerOptions.RowGroupSize, writerOptions.PageSize,
+		writerOptions.Parallelism)
+
+	return nil
 
 }
 
-func NewFileWriter(path string) (*Writer, error) {
+// Returns a Writer which writes to sink.  Closing the Writer closes the
+// sink.
+func NewWriter(sink Sink, schema *Schema, opts WriterOptions) (*Writer,
+	error) {
 
-	f, err := ParquetFile.NewLocalFileWriter(path)
-	if err != nil {
-		return nil, err
-	}
+	pf := ParquetFile.NewWriterFile(sink)
 
-	// 4 writer goroutines.
-	pw, err := ParquetWriter.NewParquetWriter(f, new(FlatEvent), 4)
+	pw, err := ParquetWriter.NewParquetWriter(pf, schema.Object(),
+		opts.Parallelism)
 	if err != nil {
-		f.Close()
+		sink.Abort()
 		return nil, err
 	}
-	pw.RowGroupSize = 128 * 1024 * 1024 // 128M
-	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	pw.RowGroupSize = opts.RowGroupSize
+	pw.PageSize = opts.PageSize
+	pw.CompressionType = opts.Compression
+
+	// Record the settings in the footer, so files written with different
+	// settings can be told apart when comparing them.
+	meta := []string{
+		"parquetstorage.compression", opts.Compression.String(),
+		"parquetstorage.row_group_size", strconv.FormatInt(opts.RowGroupSize, 10),
+		"parquetstorage.page_size", strconv.FormatInt(opts.PageSize, 10),
+		"parquetstorage.parallelism", strconv.FormatInt(opts.Parallelism, 10),
+	}
+	for i := 0; i < len(meta); i += 2 {
+		pw.Footer.KeyValueMetadata = append(pw.Footer.KeyValueMetadata,
+			&parquet.KeyValue{Key: meta[i], Value: &meta[i+1]})
+	}
 
-	w := &Writer{f: f, pw: pw}
+	w := &Writer{f: pf, pw: pw, sink: sink}
 
 	return w, nil
 
 }
 
+// Writes the footer and closes the sink.  The sink is aborted if the footer
+// can't be written.
 func (w *Writer) Close() error {
 	err := w.pw.WriteStop()
 	if err != nil {
 		w.f.Close()
+		w.sink.Abort()
 		return err
 	}
 	w.f.Close()
-	return nil
+	return w.sink.Close()
+}
+
+// Discards everything written.
+func (w *Writer) Abort() error {
+	w.f.Close()
+	return w.sink.Abort()
+}
+
+// Estimated size of the Parquet file so far: what has been flushed, plus
+// encoded pages not yet flushed, plus rows not yet encoded.  The last is
+// an uncompressed estimate, but is bounded by the page size.
+func (w *Writer) Size() int64 {
+	return w.pw.Offset + w.pw.Size + w.pw.ObjsSize
 }
 
 func (w *Writer) Write(d interface{}) error {
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"268435456", 268435456, true},
+		{"256M", 256 * 1024 * 1024, true},
+		{"256m", 256 * 1024 * 1024, true},
+		{"8K", 8 * 1024, true},
+		{" 2 G ", 2 * 1024 * 1024 * 1024, true},
+		{"\"128M\"", 128 * 1024 * 1024, true},
+		{"M", 0, false},
+		{"12X", 0, false},
+		{"9999999999999G", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("parseSize(%q) = %v, %v, want %v", tt.in, got, err,
+				tt.want)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("parseSize(%q) = %v, want an error", tt.in, got)
+		}
+	}
+
+}
+
+// Parallelism is a goroutine count, not a size.
+func TestWriterParallelism(t *testing.T) {
+
+	saved := writerOptions
+	defer func() { writerOptions = saved }()
+	defer os.Unsetenv("PARQUET_PARALLELISM")
+
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"4", 4, true},
+		{"16", 16, true},
+		{"4K", 0, false},
+		{"0", 0, false},
+		{"100000", 0, false},
+	}
+
+	for _, tt := range tests {
+		os.Setenv("PARQUET_PARALLELISM", tt.in)
+		err := setWriterOptions()
+		if tt.ok && (err != nil || writerOptions.Parallelism != tt.want) {
+			t.Errorf("%s: parallelism %v, %v", tt.in,
+				writerOptions.Parallelism, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: accepted", tt.in)
+		}
+	}
+
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/trustnetworks/analytics-common/cloudstorage"
 	dt "github.com/trustnetworks/analytics-common/datatypes"
 	"github.com/trustnetworks/analytics-common/utils"
 	"github.com/trustnetworks/analytics-common/worker"
@@ -19,83 +21,94 @@ import (
 
 const pgm = "parquetstorage"
 
-// The queue consists of flat events plus the original event size.
+// The queue consists of flat events.  stored, if set, receives the outcome
+// of uploading the batch holding the event.
 type QueueItem struct {
-	event *FlatEvent
-	size  int
+	event  *FlatEvent
+	stored chan error
 }
 
 // Flat event queue size
 const feQueueSize = 10000
 
+// How often the queue handler checks whether the batch has reached MAX_TIME.
+const rotateInterval = time.Second
+
 var maxBatch int64
 var maxTime float64
+var shutdownTimeout time.Duration
 var ctx context.Context
-var pqwr *Writer
-var path string
-var uid string
-var tm string
-var data bytes.Buffer
 
 type work struct {
-	storage      cloudstorage.CloudStorage // Platform-specific storage
-	project      string
-	basedir      string
-	count        int64
-	items        int64
-	last         time.Time
-	stripPayload bool
-	feQueue      chan QueueItem
+	storage   Storage          // Platform-specific storage
+	streaming StreamingStorage // Set if streaming uploads
+	spool     *Spool           // Objects awaiting upload
+	project   string
+	basedir   string
+	flattener Flattener
+	schema    *Schema
+	feQueue   chan QueueItem
+
+	// Open batches, keyed by partition.  Only touched by the QueueHandler
+	// goroutine.
+	batches map[string]*batch
+
+	// Shutdown control.  Handle holds accept for reading while it queues
+	// an event, so once closing is set under the write lock no further
+	// events can enter feQueue.
+	accept  sync.RWMutex
+	closing bool
+	stop    chan struct{}
+	done    chan struct{}
 }
 
-// TODO: this is identical to analytics-storage except for
-// default batch size
 func setMaxBatchSize() {
 	var err error
 
-	// Default file size, if no batch size env value set
-	// Default of 64M is optimal value for our data
+	// Default file size, if no batch size env value set.  This is the
+	// size of the Parquet object, not of the events going into it.
 	var defaultMaxBatch int64 = 268435456 // 256 * 1024 * 1024
-	var mBytes = false
-	var kBytes = false
 
-	// Get batch size env value and trim, remove spaces and M or K
+	// Check max batch size value set in env is parsable, if not use
+	// default value
 	mBatchFromEnv := utils.Getenv("MAX_BATCH", "268435456")
-	mBatch := strings.Replace(mBatchFromEnv, "\"", "", -1)
-	if strings.Contains(strings.ToUpper(mBatch), "M") {
-		mBatch = strings.Replace(strings.ToUpper(mBatch), "M", "", -1)
-		mBytes = true
-	} else if strings.Contains(strings.ToUpper(mBatch), "K") {
-		mBatch = strings.Replace(strings.ToUpper(mBatch), "K", "", -1)
-		kBytes = true
-	}
-	mBatch = strings.Replace(mBatch, " ", "", -1)
-	mBatch = strings.TrimSpace(mBatch)
-
-	// Check max batch size value set in env is parsable to int, if not use default value
-	maxBatch, err = strconv.ParseInt(mBatch, 10, 64)
-	if err != nil {
+	maxBatch, err = parseSize(mBatchFromEnv)
+	if err != nil || maxBatch < 1 {
 		maxBatch = defaultMaxBatch
 		utils.Log("Couldn't parse MAX_BATCH: %v :using default %v", mBatchFromEnv, defaultMaxBatch)
+	}
 
-	} else {
-		if mBytes == true {
-			if maxBatch < ((math.MaxInt64 / 1024) / 1024) {
-				maxBatch = maxBatch * 1024 * 1024
-			} else {
-				utils.Log("Couldn't convert MAX_BATCH to Megabytes: %v :using default %v", mBatchFromEnv, defaultMaxBatch)
-			}
-		} else if kBytes == true {
-			if maxBatch < (math.MaxInt64 / 1024) {
-				maxBatch = maxBatch * 1024
-			} else {
-				utils.Log("Couldn't convert MAX_BATCH to Kilobytes: %v :using default %v", mBatchFromEnv, defaultMaxBatch)
-			}
-		}
+	utils.Log("maxBatch set to: %v", maxBatch)
+}
+
+// Parses a size in bytes, with an optional K, M or G suffix.
+func parseSize(s string) (int64, error) {
 
+	s = strings.ToUpper(strings.TrimSpace(strings.Replace(s, "\"", "", -1)))
+
+	var mult int64 = 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1024
+	case strings.HasSuffix(s, "M"):
+		mult = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		mult = 1024 * 1024 * 1024
+	}
+	if mult != 1 {
+		s = strings.TrimSpace(s[:len(s)-1])
 	}
 
-	utils.Log("maxBatch set to: %v", maxBatch)
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("%s is too large", s)
+	}
+
+	return n * mult, nil
+
 }
 
 // TODO: this is identical to code in analytics-storage
@@ -122,31 +135,162 @@ func setMaxTime() {
 	utils.Log("maxTime set to: %v", maxTime)
 }
 
+func setShutdownTimeout() {
+
+	// Default time allowed to flush the final batch on shutdown.  Should
+	// be comfortably less than the pod's termination grace period.
+	var defaultShutdownTimeout float64 = 25
+
+	sTimeFromEnv := utils.Getenv("SHUTDOWN_TIMEOUT", "25")
+	sTime := strings.Replace(sTimeFromEnv, "\"", "", -1)
+	sTime = strings.Replace(sTime, " ", "", -1)
+	sTime = strings.TrimSpace(sTime)
+
+	secs, err := strconv.ParseFloat(sTime, 64)
+	if err != nil {
+		utils.Log("Couldn't parse SHUTDOWN_TIMEOUT: %v :using default %v", sTimeFromEnv, defaultShutdownTimeout)
+		secs = defaultShutdownTimeout
+	}
+	shutdownTimeout = time.Duration(secs * float64(time.Second))
+
+	utils.Log("shutdownTimeout set to: %v", shutdownTimeout)
+}
+
 func (s *work) init() error {
 
 	var err error
 
 	s.feQueue = make(chan QueueItem, feQueueSize)
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
 
 	setMaxBatchSize()
 	setMaxTime()
+	setShutdownTimeout()
+	setPartitionPeriod()
+	setMaxPartitions()
+
+	err = setPartitionLayout()
+	if err != nil {
+		return err
+	}
+	err = setWriterOptions()
+	if err != nil {
+		return err
+	}
 
 	s.project = utils.Getenv("STORAGE_PROJECT", "")
 	s.basedir = utils.Getenv("STORAGE_BASEDIR", "parquet")
 
-	s.count = 0
-	s.items = 0
-	s.last = time.Now()
+	s.batches = make(map[string]*batch)
 
-	s.stripPayload = utils.Getenv("STRIP_PAYLOAD", "false") == "true"
+	s.schema, err = NewSchemaFromConfig()
+	if err != nil {
+		return err
+	}
 
-	s.storage = cloudstorage.New(utils.Getenv("PLATFORM", ""))
-	s.storage.Init("STORAGE_BUCKET", "")
+	// Payloads go in the Parquet file (inline), or in objects of their
+	// own (sidecar).
+	payloadStore := utils.Getenv("PAYLOAD_STORE", "inline")
+	switch payloadStore {
+	case "inline", "sidecar":
+	default:
+		return fmt.Errorf("PAYLOAD_STORE %s not known", payloadStore)
+	}
+	utils.Log("payloadStore set to: %v", payloadStore)
+
+	// Payloads are left out unless STRIP_PAYLOAD=false, which can be
+	// overridden for each type of payload.  A sidecar store is there for
+	// payloads, so with one they're written unless stripped.
+	defaultStrip := strconv.FormatBool(payloadStore != "sidecar")
+	stripPayload := utils.Getenv("STRIP_PAYLOAD", defaultStrip) == "true"
+	writePayload := func(env string) bool {
+		def := strconv.FormatBool(!stripPayload)
+		write := utils.Getenv(env, def) == "true"
+		utils.Log("%s set to: %v", env, write)
+		return write
+	}
+	s.flattener.WriteHttpBody = writePayload("WRITE_HTTP_BODY")
+	s.flattener.WriteIcmpPayload = writePayload("WRITE_ICMP_PAYLOAD")
+	s.flattener.WriteDatagramPayload = writePayload("WRITE_DATAGRAM_PAYLOAD")
+	s.flattener.WriteStreamPayload = writePayload("WRITE_STREAM_PAYLOAD")
+
+	if payloadStore == "sidecar" && !s.flattener.WriteHttpBody &&
+		!s.flattener.WriteIcmpPayload &&
+		!s.flattener.WriteDatagramPayload &&
+		!s.flattener.WriteStreamPayload {
+		return errors.New("PAYLOAD_STORE sidecar, but every payload " +
+			"type is stripped")
+	}
+
+	mPayloadFromEnv := utils.Getenv("MAX_PAYLOAD_LENGTH", "0")
+	s.flattener.MaxPayloadLength, err = strconv.Atoi(strings.TrimSpace(mPayloadFromEnv))
+	if err != nil || s.flattener.MaxPayloadLength < 0 {
+		utils.Log("Couldn't parse MAX_PAYLOAD_LENGTH: %v :using no limit", mPayloadFromEnv)
+		s.flattener.MaxPayloadLength = 0
+	}
+	utils.Log("maxPayloadLength set to: %v", s.flattener.MaxPayloadLength)
+
+	// Authorization, Cookie and friends are redacted unless
+	// WRITE_CREDENTIAL_HEADERS=true.
+	s.flattener.WriteCredentialHeaders =
+		utils.Getenv("WRITE_CREDENTIAL_HEADERS", "false") == "true"
+	utils.Log("writeCredentialHeaders set to: %v",
+		s.flattener.WriteCredentialHeaders)
+
+	// Events with a time which can't be parsed are stored at 1970, or
+	// with TIME_FALLBACK=receive at the time they were received.
+	s.flattener.ReceiveTimeFallback =
+		utils.Getenv("TIME_FALLBACK", "epoch") == "receive"
+
+	// At-least-once needs the worker to hold each message's ack until its
+	// batch is uploaded, which it can't yet do.  The worker acks a message
+	// as soon as Handle returns, and blocking Handle until upload gives
+	// one tiny batch per in-flight message.
+	if utils.Getenv("AT_LEAST_ONCE", "false") == "true" {
+		return errors.New("AT_LEAST_ONCE not supported, the worker " +
+			"can't defer acknowledgements")
+	}
+
+	// With STREAM_UPLOAD=true objects are uploaded as they are written
+	// rather than going through the spool.  Not every platform supports
+	// it.  Nothing is kept locally, so an upload which fails when the
+	// batch is closed loses the batch.
+	stream := utils.Getenv("STREAM_UPLOAD", "false") == "true"
+	utils.Log("streamUpload set to: %v", stream)
 
-	//create parquet writer
-	pqwr, err = NewWriter(&data)
+	platform := utils.Getenv("PLATFORM", "")
+	s.storage, err = NewStorage(platform, stream)
 	if err != nil {
-		utils.Log("Couldn't create parquet writer: %s", err.Error())
+		return err
+	}
+	if stream {
+		s.streaming = s.storage.(StreamingStorage)
+	}
+
+	// With local storage the spool defaults to a hidden directory under
+	// the storage root, so nothing outside it needs to be writable.
+	defaultSpoolDir := "/var/spool/parquetstorage"
+	if platform == "local" {
+		defaultSpoolDir = filepath.Join(utils.Getenv("STORAGE_ROOT",
+			defaultStorageRoot), ".spool")
+	}
+
+	s.spool, err = NewSpool(utils.Getenv("SPOOL_DIR", defaultSpoolDir),
+		s.storage)
+	if err != nil {
+		return err
+	}
+
+	// Pick up anything a previous run didn't manage to upload.
+	err = s.spool.Recover()
+	if err != nil {
+		return err
+	}
+
+	if payloadStore == "sidecar" {
+		s.flattener.Payloads = NewSidecarStore(
+			utils.Getenv("PAYLOAD_BASEDIR", "payloads"), s.spool)
 	}
 
 	return nil
@@ -164,82 +308,250 @@ func (s *work) Handle(msg []uint8, w *worker.Worker) error {
 		return nil
 	}
 
-	fl := Flattener{
-		WritePayloads: false,
+	//flatten json event
+	oe := s.flattener.FlattenEvent(&e)
+
+	s.accept.RLock()
+
+	// Refuse the event once shutdown has begun, it would never be stored.
+	if s.closing {
+		s.accept.RUnlock()
+		return errors.New("shutting down, event not accepted")
 	}
 
-	//flatten json event
-	oe := fl.FlattenEvent(&e)
+	s.feQueue <- QueueItem{event: oe}
 
-	s.feQueue <- QueueItem{event: oe, size: len(msg)}
+	s.accept.RUnlock()
 
 	return nil
 
 }
 
-func (s *work) QueueHandler() error {
+func (s *work) QueueHandler() {
+
+	defer close(s.done)
+
+	// Time based rotation is driven from here rather than by incoming
+	// events, so a quiet queue still gets its batch uploaded.
+	tick := time.NewTicker(rotateInterval)
+	defer tick.Stop()
 
 	for {
 
-		oe := <-s.feQueue
-		err := s.HandleQueueItem(oe)
-		if err != nil {
-			utils.Log("Couldn't process queue item: %s", err.Error())
+		select {
+		case oe := <-s.feQueue:
+			err := s.HandleQueueItem(oe)
+			if err != nil {
+				utils.Log("Couldn't process queue item: %s", err.Error())
+			}
+
+		case <-tick.C:
+			for _, b := range s.batches {
+				if time.Since(b.opened).Seconds() > maxTime {
+					s.rotate(b)
+				}
+			}
+
+		case <-s.stop:
+			s.drain()
+			return
 		}
 
 	}
 
 }
 
-func (s *work) HandleQueueItem(oe QueueItem) error {
+// Writes out everything still sitting in feQueue, then uploads the final
+// batches.  Only called once Handle is no longer accepting events.
+func (s *work) drain() {
 
-	if (s.count > maxBatch) || (time.Since(s.last).Seconds() > maxTime) {
+	for {
+		select {
+		case oe := <-s.feQueue:
+			err := s.HandleQueueItem(oe)
+			if err != nil {
+				utils.Log("Couldn't process queue item: %s", err.Error())
+			}
+		default:
+			s.rotateAll()
+			return
+		}
+	}
 
-		//create a new bucket storage path
-		tm = time.Now().Format("2006-01-02/15-04")
-		uid = uuid.New().String()
-		path := s.basedir + "/" + tm + "/" + uid + ".parquet"
+}
+
+// Stops accepting events, then waits for the queue handler to flush and
+// upload what it holds.  Gives up after timeout, anything not uploaded by
+// then stays in the spool for the next run with the same SPOOL_DIR.
+func (s *work) Shutdown(timeout time.Duration) error {
+
+	deadline := time.Now().Add(timeout)
+
+	s.accept.Lock()
+	s.closing = true
+	s.accept.Unlock()
+
+	utils.Log("Shutting down, flushing %d queued events", len(s.feQueue))
 
-		//close parquet writer
-		err := pqwr.Close()
+	close(s.stop)
+
+	select {
+	case <-s.done:
+	case <-time.After(time.Until(deadline)):
+		return errors.New("timed out flushing final batch")
+	}
+
+	n := s.spool.Wait(deadline)
+	if n > 0 {
+		return fmt.Errorf("timed out uploading, %d objects left in spool", n)
+	}
+
+	return nil
+
+}
+
+// Closes a batch's parquet writer and uploads it.  A batch with nothing in
+// it is dropped rather than uploaded as a zero-row file.
+func (s *work) rotate(b *batch) {
+
+	delete(s.batches, b.partition)
+
+	if b.items == 0 {
+		b.pqwr.Abort()
+		return
+	}
+
+	//close parquet writer
+	err := b.pqwr.Close()
+	if err != nil {
+		utils.Log("Couldn't close parquet writer, batch lost: %s",
+			err.Error())
+		complete(b.acks, err)
+		return
+	}
+
+	if s.streaming != nil {
+		// Streamed, closing the writer completed the upload.
+		complete(b.acks, nil)
+		return
+	}
+
+	if mem, ok := b.sink.(*MemorySink); ok {
+		// The spool wasn't writable when the batch was opened.  Try it
+		// again, else have the upload loop retry from memory.
+		err = s.spool.Put(b.path, mem.Bytes(), b.acks)
 		if err != nil {
-			utils.Log("Couldn't close parquet writer: %s", err.Error())
+			utils.Log("Couldn't spool %s, holding it in memory: %s",
+				b.path, err.Error())
+			s.spool.Hold(b.path, mem.Bytes(), b.acks)
+		}
+		return
+	}
+
+	// Spooled, the spool uploads it.
+	s.spool.Queue(b.path, b.acks)
+
+}
+
+// Opens the sink for a new object: a streaming upload if streaming, else a
+// spool file.  Falls back to memory if the spool can't be written.
+func (s *work) openSink(path string) (Sink, error) {
+
+	if s.streaming != nil {
+		return s.streaming.Create(path)
+	}
+
+	sink, err := s.spool.Create(path)
+	if err != nil {
+		utils.Log("Couldn't spool %s: %s", path, err.Error())
+		return NewMemorySink(), nil
+	}
+
+	return sink, nil
+
+}
+
+// Closes and uploads every open batch.
+func (s *work) rotateAll() {
+	for _, b := range s.batches {
+		s.rotate(b)
+	}
+}
+
+// Returns the open batch which was least recently written to.
+func (s *work) idlest() *batch {
+	var idlest *batch
+	for _, b := range s.batches {
+		if idlest == nil || b.used.Before(idlest.used) {
+			idlest = b
 		}
+	}
+	return idlest
+}
 
-		s.storage.Upload(path, data.Bytes())
+func (s *work) HandleQueueItem(oe QueueItem) error {
 
-		//clear buffer for the next batch data
-		data.Reset()
-		//create new parquet writer
-		pqwr, err = NewWriter(&data)
+	key := partition(oe.event)
+	b := s.batches[key]
 
-		//reset counter and time
-		s.last = time.Now()
-		s.count = 0
-		s.items = 0
+	// Rotation is done before the write, so the event which crosses the
+	// threshold goes into the new batch.  MAX_TIME is handled by the
+	// ticker in QueueHandler.
+	if b != nil && b.pqwr.Size() >= maxBatch {
+		s.rotate(b)
+		b = nil
+	}
 
-	} else {
+	if b == nil {
 
-		s.count += int64(oe.size)
-		s.items += 1
+		// Make room by closing the partition which has been quiet
+		// longest.
+		if len(s.batches) >= maxPartitions {
+			s.rotate(s.idlest())
+		}
 
-		/*if (s.items % 2500) == 0 {
-			utils.Log("items=%d size=%d qlen=%d", s.items, s.count,
-				len(s.feQueue))
-		}*/
+		//create a new bucket storage path
+		uid := uuid.New().String()
+		path := s.basedir + "/" + key + "/" + uid + ".parquet"
 
-		//convert to parquet format using parquet writer
-		err := pqwr.Write(*oe.event)
+		sink, err := s.openSink(path)
+		if err == nil {
+			b, err = newBatch(key, path, s.schema, sink)
+		}
 		if err != nil {
-			utils.Log("Couldn't write in to buffer: %s", err.Error())
-			return nil
+			complete([]chan error{oe.stored}, err)
+			return err
 		}
+		s.batches[key] = b
+
+	}
+
+	err := b.Write(oe)
+	if err != nil {
+		utils.Log("Couldn't write in to buffer: %s", err.Error())
+		// Redelivering wouldn't make the event writable, drop it.
+		complete([]chan error{oe.stored}, nil)
+		return nil
 	}
 
+	/*if (b.items % 2500) == 0 {
+		utils.Log("items=%d size=%d qlen=%d", b.items, b.pqwr.Size(),
+			len(s.feQueue))
+	}*/
+
 	return nil
 
 }
 
+// Tells the handlers waiting on a batch how its upload went.
+func complete(acks []chan error, err error) {
+	for _, ack := range acks {
+		if ack != nil {
+			ack <- err
+		}
+	}
+}
+
 func (s *work) QueueSizeReporter() {
 	for {
 		qln := len(s.feQueue)
@@ -285,6 +597,7 @@ func main() {
 		return
 	}
 
+	go s.spool.Run()
 	go s.QueueHandler()
 	//go s.QueueSizeReporter()
 
@@ -296,4 +609,13 @@ func main() {
 		utils.Log("error: Event handling failed with err: %s", err.Error())
 	}
 
+	// The worker has stopped delivering events, store what we still hold
+	// before exiting.
+	err = s.Shutdown(shutdownTimeout)
+	if err != nil {
+		utils.Log("error: Shutdown: %s", err.Error())
+	}
+
+	utils.Log("Shutdown complete.")
+
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go/ParquetFile"
+	"github.com/xitongsys/parquet-go/ParquetReader"
+)
+
+// Returns a work which streams objects into local storage under dir.
+func newTestWork(t *testing.T, dir string) *work {
+
+	ls, err := newLocalStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := NewSpool(filepath.Join(dir, "spool"), ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema, err := NewSchemaFromConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partitionPeriod = time.Hour
+	maxPartitions = 4
+	hivePartitions = false
+
+	return &work{
+		storage:   ls,
+		streaming: ls,
+		spool:     spool,
+		basedir:   "parquet",
+		schema:    schema,
+		feQueue:   make(chan QueueItem, feQueueSize),
+		batches:   make(map[string]*batch),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+}
+
+// Returns the number of rows in each Parquet object under dir.
+func countRows(t *testing.T, dir string, schema *Schema) map[string]int64 {
+
+	rows := map[string]int64{}
+
+	err := filepath.Walk(dir, func(file string, info os.FileInfo,
+		err error) error {
+
+		if err != nil || !strings.HasSuffix(file, ".parquet") {
+			return err
+		}
+
+		pf, err := ParquetFile.NewLocalFileReader(file)
+		if err != nil {
+			return err
+		}
+		defer pf.Close()
+
+		pr, err := ParquetReader.NewParquetReader(pf, schema.Object(), 1)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err.Error())
+		}
+		rows[file] = pr.GetNumRows()
+		pr.ReadStop()
+
+		return nil
+
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rows
+
+}
+
+// Every event must land in exactly one object, however many rotations it
+// takes, including the events which trigger rotation.
+func TestRotationKeepsEveryEvent(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "parquetstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestWork(t, dir)
+
+	saved := maxBatch
+	defer func() { maxBatch = saved }()
+	maxBatch = 2048
+
+	const n = 1000
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < n; i++ {
+		// Alternate between two partitions.
+		tm := start.Add(time.Duration(i%2) * time.Hour)
+		oe := &FlatEvent{
+			Id:         fmt.Sprintf("event-%d", i),
+			Action:     "unrecognised_stream",
+			Time:       tm.Format(time.RFC3339),
+			TimeMicros: tm.UnixNano() / 1000,
+		}
+		err := s.HandleQueueItem(QueueItem{event: oe})
+		if err != nil {
+			t.Fatalf("event %d: %s", i, err.Error())
+		}
+	}
+
+	s.rotateAll()
+
+	if len(s.batches) != 0 {
+		t.Errorf("%d batches left open", len(s.batches))
+	}
+
+	rows := countRows(t, dir, s.schema)
+
+	var total int64
+	for _, r := range rows {
+		total += r
+	}
+
+	if total != n {
+		t.Errorf("wrote %d events, read back %d rows", n, total)
+	}
+
+	// Make sure the test did rotate, in both partitions.
+	if len(rows) < 4 {
+		t.Errorf("only %d objects written, expected many rotations",
+			len(rows))
+	}
+
+}
+
+// Until the worker can defer acks, at-least-once is refused rather than
+// emulated by blocking Handle.
+func TestAtLeastOnceRefused(t *testing.T) {
+
+	os.Setenv("AT_LEAST_ONCE", "true")
+	defer os.Unsetenv("AT_LEAST_ONCE")
+
+	var s work
+	err := s.init()
+	if err == nil {
+		t.Error("AT_LEAST_ONCE accepted")
+	}
+
+}
+
+// A sidecar store writes payloads unless told otherwise, and refuses to
+// start with nothing to store.
+func TestSidecarPayloadConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "parquetstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := map[string]string{
+		"PLATFORM":      "local",
+		"STORAGE_ROOT":  dir,
+		"PAYLOAD_STORE": "sidecar",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	var s work
+	err = s.init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.flattener.WriteHttpBody || !s.flattener.WriteStreamPayload {
+		t.Error("sidecar store without payloads")
+	}
+	if s.flattener.Payloads == nil {
+		t.Error("no payload store")
+	}
+
+	os.Setenv("STRIP_PAYLOAD", "true")
+	defer os.Unsetenv("STRIP_PAYLOAD")
+
+	s = work{}
+	err = s.init()
+	if err == nil {
+		t.Error("sidecar store with every payload stripped accepted")
+	}
+
+}
+
+// The whole pipeline, from queue message to object in local storage by way
+// of the spool, with no cloud credentials.  Run in CI.
+func TestEndToEndLocal(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "parquetstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := map[string]string{
+		"PLATFORM":        "local",
+		"STORAGE_ROOT":    dir,
+		"STORAGE_BASEDIR": "parquet",
+		"MAX_BATCH":       "4K",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	savedBatch, savedTime := maxBatch, maxTime
+	defer func() { maxBatch, maxTime = savedBatch, savedTime }()
+
+	var s work
+	err = s.init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.spool.Run()
+	go s.QueueHandler()
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		msg := fmt.Sprintf(`{"id":"event-%d","action":"dns_message",`+
+			`"time":"2018-06-01T%02d:00:00Z","src":["ipv4:10.0.0.1"],`+
+			`"dns_message":{"type":"query",`+
+			`"query":[{"name":"example.com","type":"A","class":"IN"}]}}`,
+			i, i%3)
+		err := s.Handle([]uint8(msg), nil)
+		if err != nil {
+			t.Fatalf("event %d: %s", i, err.Error())
+		}
+	}
+
+	err = s.Shutdown(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total int64
+	rows := countRows(t, filepath.Join(dir, "parquet"), s.schema)
+	for _, r := range rows {
+		total += r
+	}
+	if total != n {
+		t.Errorf("handled %d events, stored %d rows", n, total)
+	}
+	if len(rows) < 3 {
+		t.Errorf("only %d objects stored", len(rows))
+	}
+
+	// Everything uploaded, nothing left in the spool.
+	filepath.Walk(filepath.Join(dir, ".spool"), func(file string,
+		info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			t.Errorf("%s left in spool", file)
+		}
+		return nil
+	})
+
+}
@@ -0,0 +1,217 @@
+package main
+
+// Partitioning of output by event time.  Each event is batched with others
+// from the same time period, and the object lands in that period's
+// directory, so late and backfilled events are stored alongside the events
+// they happened with.
+//
+// The default layout is basedir/YYYY-MM-DD/HH-MM.  The hive layout names
+// each directory level key=value, e.g.
+// basedir/date=YYYY-MM-DD/hour=HH/action=dns_message, which Spark, Presto
+// and friends discover as partition columns.
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+var partitionPeriod time.Duration
+var maxPartitions int
+
+// Hive layout partition keys, and for keys which are FlatEvent columns the
+// index of the column's field.
+var hivePartitions bool
+var partitionKeys []string
+var partitionFields map[string]int
+
+// Value Hive uses for a partition with no value.
+const hiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// Partitioning by a column, such as action, spreads events over far more
+// partitions than time alone.  With fewer open partitions than this,
+// interleaved events keep closing batches long before they fill.
+const minColumnPartitions = 16
+
+func setPartitionPeriod() {
+	var err error
+
+	// Default to hourly partitions
+	var defaultPartitionPeriod = time.Hour
+
+	pPeriodFromEnv := utils.Getenv("PARTITION_PERIOD", "1h")
+	pPeriod := strings.Replace(pPeriodFromEnv, "\"", "", -1)
+	pPeriod = strings.TrimSpace(pPeriod)
+
+	partitionPeriod, err = time.ParseDuration(pPeriod)
+	if err != nil || partitionPeriod < time.Minute {
+		utils.Log("Couldn't parse PARTITION_PERIOD: %v :using default %v", pPeriodFromEnv, defaultPartitionPeriod)
+		partitionPeriod = defaultPartitionPeriod
+	}
+
+	utils.Log("partitionPeriod set to: %v", partitionPeriod)
+}
+
+func setMaxPartitions() {
+	var err error
+
+	// Each open partition holds a row group in memory, keep the default
+	// low.
+	var defaultMaxPartitions = 4
+
+	mPartitionsFromEnv := utils.Getenv("MAX_PARTITIONS", "4")
+	mPartitions := strings.Replace(mPartitionsFromEnv, "\"", "", -1)
+	mPartitions = strings.TrimSpace(mPartitions)
+
+	maxPartitions, err = strconv.Atoi(mPartitions)
+	if err != nil || maxPartitions < 1 {
+		utils.Log("Couldn't parse MAX_PARTITIONS: %v :using default %v", mPartitionsFromEnv, defaultMaxPartitions)
+		maxPartitions = defaultMaxPartitions
+	}
+
+	utils.Log("maxPartitions set to: %v", maxPartitions)
+}
+
+func setPartitionLayout() error {
+
+	layout := utils.Getenv("PARTITION_LAYOUT", "time")
+
+	switch layout {
+	case "time":
+		hivePartitions = false
+	case "hive":
+		hivePartitions = true
+	default:
+		return fmt.Errorf("PARTITION_LAYOUT %s not known", layout)
+	}
+
+	utils.Log("partitionLayout set to: %v", layout)
+
+	if !hivePartitions {
+		return nil
+	}
+
+	// date, hour and minute come from the event time, anything else
+	// must be a FlatEvent column.  A name shared by several fields, such
+	// as event_time, is ambiguous and marked -1.
+	columns := make(map[string]int)
+	t := reflect.TypeOf(FlatEvent{})
+	for i := 0; i < t.NumField(); i++ {
+		name := parquetName(t.Field(i))
+		if _, ok := columns[name]; ok {
+			columns[name] = -1
+		} else {
+			columns[name] = i
+		}
+	}
+
+	partitionKeys = nil
+	partitionFields = make(map[string]int)
+
+	keys := utils.Getenv("PARTITION_KEYS", "date,hour")
+	for _, key := range strings.Split(keys, ",") {
+
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+
+		switch key {
+		case "date", "hour", "minute":
+		default:
+			field, ok := columns[key]
+			if !ok {
+				return fmt.Errorf("PARTITION_KEYS: no column %s", key)
+			}
+			if field < 0 {
+				return fmt.Errorf("PARTITION_KEYS: can't partition by "+
+					"%s, use date, hour and minute", key)
+			}
+			switch t.Field(field).Type.Kind() {
+			case reflect.String, reflect.Int32, reflect.Int64:
+			default:
+				return fmt.Errorf("PARTITION_KEYS: can't partition by %s",
+					key)
+			}
+			partitionFields[key] = field
+		}
+
+		partitionKeys = append(partitionKeys, key)
+
+	}
+
+	utils.Log("partitionKeys set to: %v", partitionKeys)
+
+	if len(partitionFields) > 0 && maxPartitions < minColumnPartitions {
+		utils.Log("Warning: MAX_PARTITIONS %d is low for PARTITION_KEYS "+
+			"%v, objects will be small unless it's at least the number "+
+			"of values in use", maxPartitions, partitionKeys)
+	}
+
+	return nil
+
+}
+
+// Returns the partition an event belongs to.  This is also the directory,
+// relative to basedir, its object is stored in.
+func partition(oe *FlatEvent) string {
+
+	tm := time.Unix(0, oe.TimeMicros*1000).UTC().Truncate(partitionPeriod)
+
+	if !hivePartitions {
+		return tm.Format("2006-01-02/15-04")
+	}
+
+	dirs := make([]string, 0, len(partitionKeys))
+	for _, key := range partitionKeys {
+
+		var val string
+		switch key {
+		case "date":
+			val = tm.Format("2006-01-02")
+		case "hour":
+			val = tm.Format("15")
+		case "minute":
+			val = tm.Format("04")
+		default:
+			field := reflect.ValueOf(oe).Elem().Field(partitionFields[key])
+			val = fmt.Sprint(field.Interface())
+		}
+
+		if val == "" {
+			val = hiveDefaultPartition
+		} else {
+			val = hiveEscape(val)
+		}
+
+		dirs = append(dirs, key+"="+val)
+
+	}
+
+	return strings.Join(dirs, "/")
+
+}
+
+// Escapes a partition value the way Hive does, so it's safe as a path
+// component and reads back as the original value.
+func hiveEscape(val string) string {
+
+	var esc bytes.Buffer
+
+	for i := 0; i < len(val); i++ {
+		c := val[i]
+		if c < 0x20 || c == 0x7f || strings.IndexByte("\"#%'*/:=?\\{[]^", c) >= 0 {
+			fmt.Fprintf(&esc, "%%%02X", c)
+		} else {
+			esc.WriteByte(c)
+		}
+	}
+
+	return esc.String()
+
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPartitionKeys(t *testing.T) {
+
+	os.Setenv("PARTITION_LAYOUT", "hive")
+	defer os.Unsetenv("PARTITION_LAYOUT")
+	defer os.Unsetenv("PARTITION_KEYS")
+
+	tests := []struct {
+		keys string
+		ok   bool
+	}{
+		{"date,hour", true},
+		{"date,action", true},
+		{"event_time", false},
+		{"date,event_time", false},
+		{"no_such_column", false},
+	}
+
+	for _, tt := range tests {
+		os.Setenv("PARTITION_KEYS", tt.keys)
+		err := setPartitionLayout()
+		if tt.ok && err != nil {
+			t.Errorf("%s: %s", tt.keys, err.Error())
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: accepted", tt.keys)
+		}
+	}
+
+	hivePartitions = false
+
+}
+
+func TestPartition(t *testing.T) {
+
+	defer func() {
+		partitionPeriod = time.Hour
+		hivePartitions = false
+		partitionKeys = nil
+	}()
+
+	os.Setenv("PARTITION_LAYOUT", "hive")
+	os.Setenv("PARTITION_KEYS", "date,hour,minute,action")
+	defer os.Unsetenv("PARTITION_LAYOUT")
+	defer os.Unsetenv("PARTITION_KEYS")
+
+	err := setPartitionLayout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hiveKeys := partitionKeys
+
+	tm := time.Date(2018, 6, 1, 12, 34, 56, 0, time.UTC)
+	micros := tm.UnixNano() / 1000
+
+	tests := []struct {
+		hive   bool
+		period time.Duration
+		action string
+		want   string
+	}{
+		{false, time.Hour, "dns_message", "2018-06-01/12-00"},
+		{false, 15 * time.Minute, "dns_message", "2018-06-01/12-30"},
+		{false, 24 * time.Hour, "dns_message", "2018-06-01/00-00"},
+		{true, time.Hour, "dns_message",
+			"date=2018-06-01/hour=12/minute=00/action=dns_message"},
+		{true, time.Minute, "dns_message",
+			"date=2018-06-01/hour=12/minute=34/action=dns_message"},
+		{true, time.Hour, "a/b=c%d",
+			"date=2018-06-01/hour=12/minute=00/action=a%2Fb%3Dc%25d"},
+		{true, time.Hour, "",
+			"date=2018-06-01/hour=12/minute=00/action=" +
+				hiveDefaultPartition},
+	}
+
+	for _, tt := range tests {
+		hivePartitions = tt.hive
+		partitionKeys = hiveKeys
+		partitionPeriod = tt.period
+		got := partition(&FlatEvent{Action: tt.action, TimeMicros: micros})
+		if got != tt.want {
+			t.Errorf("hive=%v period=%v action=%q: got %s, want %s",
+				tt.hive, tt.period, tt.action, got, tt.want)
+		}
+	}
+
+}
+
+func TestHiveEscape(t *testing.T) {
+
+	tests := []struct {
+		val  string
+		want string
+	}{
+		{"dns_message", "dns_message"},
+		{"a/b", "a%2Fb"},
+		{"a=b", "a%3Db"},
+		{"100%", "100%25"},
+		{"a:b", "a%3Ab"},
+		{"tab\there", "tab%09here"},
+		{"café", "café"},
+	}
+
+	for _, tt := range tests {
+		got := hiveEscape(tt.val)
+		if got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.val, got, tt.want)
+		}
+	}
+
+}
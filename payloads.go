@@ -0,0 +1,83 @@
+package main
+
+// Sidecar store for payloads.  Rather than bloating the Parquet files,
+// payloads are stored as objects of their own named by their SHA-1, under
+// PAYLOAD_BASEDIR/<first two hex digits>/<sha1>.  The FlatEvent keeps the
+// hash and length, which is enough to fetch the payload when it's wanted.
+
+import (
+	"sync"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Somewhere payloads are put, keyed by SHA-1.
+type PayloadStore interface {
+	Put(hash string, payload []byte)
+}
+
+// Number of recently stored hashes remembered, to avoid storing the same
+// payload again.
+const payloadSeenSize = 100000
+
+// Payload store which uploads through the spool.
+type SidecarStore struct {
+	basedir string
+	spool   *Spool
+
+	lock sync.Mutex
+	seen map[string]bool
+	fifo []string
+}
+
+func NewSidecarStore(basedir string, spool *Spool) *SidecarStore {
+	return &SidecarStore{
+		basedir: basedir,
+		spool:   spool,
+		seen:    make(map[string]bool),
+	}
+}
+
+func (ss *SidecarStore) Put(hash string, payload []byte) {
+
+	if len(payload) == 0 {
+		return
+	}
+
+	ss.lock.Lock()
+	if ss.seen[hash] {
+		ss.lock.Unlock()
+		return
+	}
+	ss.seen[hash] = true
+	ss.fifo = append(ss.fifo, hash)
+	if len(ss.fifo) > payloadSeenSize {
+		delete(ss.seen, ss.fifo[0])
+		ss.fifo = ss.fifo[1:]
+	}
+	ss.lock.Unlock()
+
+	path := ss.basedir + "/" + hash[:2] + "/" + hash
+
+	err := ss.spool.Put(path, payload, nil)
+	if err != nil {
+		utils.Log("Couldn't spool payload %s: %s", hash, err.Error())
+		ss.lock.Lock()
+		delete(ss.seen, hash)
+		ss.lock.Unlock()
+	}
+
+}
+
+// Checks a hash is a hex SHA-1, and so safe to use in an object path.
+func validSha1(hash string) bool {
+	if len(hash) != 40 {
+		return false
+	}
+	for _, c := range hash {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')) {
+			return false
+		}
+	}
+	return true
+}
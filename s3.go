@@ -0,0 +1,201 @@
+package main
+
+// S3 storage, for AWS and for S3-compatible stores such as MinIO and Ceph
+// RGW.  Objects are sent as multipart uploads, which S3 only makes visible
+// once the upload completes.
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Multipart upload part size.  Each part is buffered before it's sent.
+const s3PartSize = 16 * 1024 * 1024
+
+var errUploadAborted = errors.New("upload aborted")
+
+type s3Storage struct {
+	bucket   string
+	uploader *s3manager.Uploader
+}
+
+// Credentials come from the usual AWS environment variables or
+// ~/.aws/credentials.  S3_ENDPOINT, S3_PATH_STYLE, S3_CA_FILE and
+// S3_TLS_INSECURE are for S3-compatible stores, AWS needs none of them.
+func newS3Storage() (*s3Storage, error) {
+
+	bucket := utils.Getenv("STORAGE_BUCKET", "")
+	if bucket == "" {
+		return nil, errors.New("STORAGE_BUCKET not set")
+	}
+
+	endpoint := utils.Getenv("S3_ENDPOINT", "")
+	region := utils.Getenv("S3_REGION",
+		utils.Getenv("AWS_BUCKET_REGION", "us-east-1"))
+
+	// MinIO and Ceph generally want path-style addressing, as bucket
+	// subdomains need wildcard DNS.
+	pathStyle := utils.Getenv("S3_PATH_STYLE", "false") == "true"
+
+	client, err := s3HttpClient(utils.Getenv("S3_CA_FILE", ""),
+		utils.Getenv("S3_TLS_INSECURE", "false") == "true")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := aws.NewConfig().
+		WithRegion(region).
+		WithS3ForcePathStyle(pathStyle)
+	if client != nil {
+		cfg = cfg.WithHTTPClient(client)
+	}
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = s3PartSize
+	})
+
+	if endpoint == "" {
+		endpoint = "default endpoint"
+	}
+	utils.Log("Storing objects in s3 bucket %s (%s, %s, pathStyle=%v)",
+		bucket, endpoint, region, pathStyle)
+
+	return &s3Storage{bucket: bucket, uploader: uploader}, nil
+
+}
+
+// Returns an HTTP client which trusts caFile, if set, as well as the
+// system roots.  insecure turns off certificate verification altogether,
+// which is only sensible against a test store.  With neither the SDK's
+// default client is used, and nil is returned.
+func s3HttpClient(caFile string, insecure bool) (*http.Client, error) {
+
+	if caFile == "" && !insecure {
+		return nil, nil
+	}
+
+	tc := &tls.Config{InsecureSkipVerify: insecure}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	// The timeouts of http.DefaultTransport.  S3 doesn't speak HTTP/2,
+	// so nothing is lost by a custom TLS config turning it off.
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       tc,
+	}
+
+	return &http.Client{Transport: tr}, nil
+
+}
+
+func (s *s3Storage) Upload(path string, data []byte) error {
+
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path),
+		Body:   bytes.NewReader(data),
+	})
+
+	return err
+
+}
+
+// Streams the object through a pipe into a multipart upload.
+func (s *s3Storage) Create(path string) (Sink, error) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+
+	sink := &s3Sink{
+		pw:     pw,
+		cancel: cancel,
+		done:   make(chan error, 1),
+	}
+
+	go func() {
+		_, err := s.uploader.UploadWithContext(ctx,
+			&s3manager.UploadInput{
+				Bucket: aws.String(s.bucket),
+				Key:    aws.String(path),
+				Body:   pr,
+			})
+		// Unblock any writer if the upload failed early.
+		pr.CloseWithError(err)
+		sink.done <- err
+	}()
+
+	return sink, nil
+
+}
+
+type s3Sink struct {
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	done   chan error
+}
+
+func (s *s3Sink) Write(p []byte) (int, error) {
+	return s.pw.Write(p)
+}
+
+// Waits for the last part to be sent and the upload completed.
+func (s *s3Sink) Close() error {
+	defer s.cancel()
+	s.pw.Close()
+	return <-s.done
+}
+
+// The uploader aborts the multipart upload, so no parts are left behind.
+func (s *s3Sink) Abort() error {
+	s.pw.CloseWithError(errUploadAborted)
+	s.cancel()
+	<-s.done
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Runs against a real store, only when S3_ENDPOINT is set.  make minio
+// starts one, make test-s3 runs these against it.
+func newTestS3(t *testing.T) (*s3Storage, string) {
+
+	if os.Getenv("S3_ENDPOINT") == "" {
+		t.Skip("S3_ENDPOINT not set")
+	}
+
+	s, err := newS3Storage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep runs apart.
+	prefix := fmt.Sprintf("test-%d/", time.Now().UnixNano())
+
+	return s, prefix
+
+}
+
+func (s *s3Storage) get(path string) ([]byte, error) {
+
+	out, err := s.uploader.S3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	return ioutil.ReadAll(out.Body)
+
+}
+
+func (s *s3Storage) exists(path string) bool {
+	_, err := s.uploader.S3.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path),
+	})
+	return err == nil
+}
+
+func TestS3Upload(t *testing.T) {
+
+	s, prefix := newTestS3(t)
+
+	err := s.Upload(prefix+"a/object.parquet", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.get(prefix + "a/object.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" {
+		t.Errorf("stored %q", data)
+	}
+
+}
+
+func TestS3CreateClose(t *testing.T) {
+
+	s, prefix := newTestS3(t)
+
+	sink, err := s.Create(prefix + "object.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More than one part.
+	chunk := make([]byte, 1024*1024)
+	for i := range chunk {
+		chunk[i] = byte(i)
+	}
+	const chunks = s3PartSize/(1024*1024) + 4
+	for i := 0; i < chunks; i++ {
+		_, err := sink.Write(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.get(prefix + "object.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != chunks*len(chunk) {
+		t.Errorf("wrote %d bytes, stored %d", chunks*len(chunk), len(data))
+	}
+
+}
+
+func TestS3Abort(t *testing.T) {
+
+	s, prefix := newTestS3(t)
+
+	sink, err := s.Create(prefix + "object.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sink.Write([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sink.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.exists(prefix + "object.parquet") {
+		t.Error("aborted object stored")
+	}
+
+}
+
+// The SDK's own client is kept unless TLS needs configuring.
+func TestS3HttpClient(t *testing.T) {
+
+	client, err := s3HttpClient("", false)
+	if err != nil || client != nil {
+		t.Errorf("no TLS options: got %v, %v, want the default client",
+			client, err)
+	}
+
+	client, err = s3HttpClient("", true)
+	if err != nil || client == nil {
+		t.Fatalf("insecure: got %v, %v", client, err)
+	}
+	tr := client.Transport.(*http.Transport)
+	if !tr.TLSClientConfig.InsecureSkipVerify {
+		t.Error("insecure: certificates verified")
+	}
+	if tr.TLSHandshakeTimeout == 0 || tr.IdleConnTimeout == 0 {
+		t.Error("insecure: default timeouts lost")
+	}
+
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+
+	_, err = s3HttpClient(f.Name(), false)
+	if err == nil {
+		t.Error("CA file without certificates accepted")
+	}
+
+}
+
+func TestS3BucketRequired(t *testing.T) {
+
+	bucket, ok := os.LookupEnv("STORAGE_BUCKET")
+	os.Unsetenv("STORAGE_BUCKET")
+	if ok {
+		defer os.Setenv("STORAGE_BUCKET", bucket)
+	}
+
+	_, err := newS3Storage()
+	if err == nil {
+		t.Error("empty STORAGE_BUCKET accepted")
+	}
+
+}
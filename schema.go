@@ -0,0 +1,208 @@
+package main
+
+// The Parquet schema.  FlatEvent carries every column the flattener knows
+// how to fill, a Schema selects which of them are written.  This lets
+// alternative representations of the same data be switched on and off
+// without disturbing existing consumers.
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type Schema struct {
+	fields  []int        // FlatEvent field indexes, one per row field
+	headers []string     // Promoted HTTP headers, after the fields
+	rowType reflect.Type // Row struct type handed to the parquet writer
+}
+
+// The HTTP headers promoted to columns if HTTP_PROMOTED_HEADERS isn't set.
+var defaultPromotedHeaders = []string{
+	"Accept", "Accept-Encoding", "Accept-Language", "Cache-Control",
+	"Connection", "Host", "Metadata-Flavor", "Pragma", "Referer",
+	"Upgrade-Insecure-Requests", "User-Agent", "Content-Length",
+	"Content-Type", "Date", "ETag", "Server", "X-Frame-Options",
+	"X-XSS-Protection",
+}
+
+// Returns a schema with every FlatEvent field except those omit returns
+// true for, plus a column for each of the HTTP headers.
+func NewSchema(omit func(f reflect.StructField) bool, headers []string) (
+	*Schema, error) {
+
+	s := &Schema{}
+
+	var rowFields []reflect.StructField
+	names := map[string]bool{}
+
+	t := reflect.TypeOf(FlatEvent{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if omit(f) {
+			continue
+		}
+		s.fields = append(s.fields, i)
+		rowFields = append(rowFields, reflect.StructField{
+			Name: f.Name,
+			Type: f.Type,
+			Tag:  f.Tag,
+		})
+		names[f.Name] = true
+	}
+
+	// Header columns are named http_header_ plus the header name with
+	// anything awkward replaced by an underscore, e.g. User-Agent becomes
+	// http_header_User_Agent.
+	for _, h := range headers {
+		name := "HttpHeader_" + strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+				(r >= '0' && r <= '9') {
+				return r
+			}
+			return '_'
+		}, h)
+		if names[name] {
+			return nil, fmt.Errorf("HTTP header %s column clashes", h)
+		}
+		names[name] = true
+		s.headers = append(s.headers, h)
+		rowFields = append(rowFields, reflect.StructField{
+			Name: name,
+			Type: reflect.TypeOf(""),
+			Tag: reflect.StructTag(fmt.Sprintf(
+				`parquet:"name=%s, type=UTF8, encoding=PLAIN_DICTIONARY"`,
+				strings.Replace(name, "HttpHeader_", "http_header_", 1))),
+		})
+	}
+
+	s.rowType = reflect.StructOf(rowFields)
+
+	return s, nil
+
+}
+
+// Returns a schema configured from the environment.
+func NewSchemaFromConfig() (*Schema, error) {
+
+	// DNS queries and answers are written as fixed slot columns (flat),
+	// as lists of every entry (nested), or both.
+	dns := utils.Getenv("DNS_SCHEMA", "flat")
+	switch dns {
+	case "flat", "nested", "both":
+	default:
+		return nil, fmt.Errorf("DNS_SCHEMA %s not known", dns)
+	}
+	utils.Log("dnsSchema set to: %v", dns)
+
+	// Every HTTP header in a map column, and/or a comma separated list of
+	// them as columns of their own.
+	headerMap := utils.Getenv("HTTP_HEADER_MAP", "true") == "true"
+	utils.Log("httpHeaderMap set to: %v", headerMap)
+
+	headers := defaultPromotedHeaders
+	if list, ok := os.LookupEnv("HTTP_PROMOTED_HEADERS"); ok {
+		headers = nil
+		for _, h := range strings.Split(list, ",") {
+			h = strings.TrimSpace(h)
+			if h != "" {
+				headers = append(headers, h)
+			}
+		}
+	}
+	utils.Log("httpPromotedHeaders set to: %v", headers)
+
+	// Representation of the event_time column.  Spark before 2.3 only
+	// understands INT96.
+	eventTime := utils.Getenv("EVENT_TIME_TYPE", "int96")
+	switch eventTime {
+	case "millis", "micros", "int96", "none":
+	default:
+		return nil, fmt.Errorf("EVENT_TIME_TYPE %s not known", eventTime)
+	}
+	utils.Log("eventTimeType set to: %v", eventTime)
+
+	omit := map[string]bool{}
+
+	if dns == "flat" {
+		omit["dns_message_query"] = true
+		omit["dns_message_answer"] = true
+	}
+	if dns == "nested" {
+		for i := 0; i < 5; i++ {
+			omit[fmt.Sprintf("dns_message_answer_name_%d", i)] = true
+			omit[fmt.Sprintf("dns_message_answer_address_%d", i)] = true
+		}
+		omit["dns_message_query_name_0"] = true
+		omit["dns_message_query_type_0"] = true
+		omit["dns_message_query_class_0"] = true
+	}
+
+	return NewSchema(func(f reflect.StructField) bool {
+		switch f.Name {
+		case "EventTimeMillis":
+			return eventTime != "millis"
+		case "EventTimeMicros":
+			return eventTime != "micros"
+		case "EventTimeInt96":
+			return eventTime != "int96"
+		}
+		column := parquetName(f)
+		if column == "http_header" {
+			return !headerMap
+		}
+		return omit[column]
+	}, headers)
+
+}
+
+// Returns an empty row, which the parquet writer derives its schema from.
+func (s *Schema) Object() interface{} {
+	return reflect.New(s.rowType).Interface()
+}
+
+// Converts a FlatEvent to a row for the parquet writer.
+func (s *Schema) Row(oe *FlatEvent) interface{} {
+
+	src := reflect.ValueOf(oe).Elem()
+	row := reflect.New(s.rowType).Elem()
+
+	for i, f := range s.fields {
+		row.Field(i).Set(src.Field(f))
+	}
+
+	for i, h := range s.headers {
+		row.Field(len(s.fields) + i).SetString(header(oe.HttpHeader, h))
+	}
+
+	return row.Interface()
+
+}
+
+// Looks up an HTTP header.  Header names aren't case sensitive, and not
+// every client capitalises them the usual way.
+func header(headers map[string]string, name string) string {
+	if v, ok := headers[name]; ok {
+		return v
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// Returns the Parquet column name from a FlatEvent field's struct tag.
+func parquetName(f reflect.StructField) string {
+	for _, kv := range strings.Split(f.Tag.Get("parquet"), ",") {
+		kv = strings.TrimSpace(kv)
+		if strings.HasPrefix(kv, "name=") {
+			return kv[5:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package main
+
+// Sinks, where a Writer's output goes.  An object only becomes visible once
+// its sink is closed, so a failed batch never leaves a truncated object
+// behind.
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Suffix of files which are still being written.
+const tmpSuffix = ".tmp"
+
+type Sink interface {
+	io.Writer
+
+	// Finishes the object, making it visible.
+	Close() error
+
+	// Discards the object.
+	Abort() error
+}
+
+// Writes a whole object to a sink made by create, discarding it if the
+// write fails.
+func uploadTo(create func(path string) (Sink, error), path string,
+	data []byte) error {
+
+	sink, err := create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = sink.Write(data)
+	if err != nil {
+		sink.Abort()
+		return err
+	}
+
+	return sink.Close()
+
+}
+
+// Holds the object in memory.
+type MemorySink struct {
+	bytes.Buffer
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (m *MemorySink) Close() error {
+	return nil
+}
+
+func (m *MemorySink) Abort() error {
+	m.Reset()
+	return nil
+}
+
+// Writes the object to a local file.  The file is written under a hidden
+// temporary name, which Hadoop and Spark skip, and renamed into place on
+// Close.
+type FileSink struct {
+	file string
+	tmp  string
+	f    *os.File
+}
+
+func NewFileSink(file string) (*FileSink, error) {
+
+	fs := &FileSink{
+		file: file,
+		tmp: filepath.Join(filepath.Dir(file),
+			"."+filepath.Base(file)+tmpSuffix),
+	}
+
+	// Something else (the spool uploader) may tidy away empty directories,
+	// so the directory can vanish between creating it and creating the
+	// file.  Try again if that happens.
+	var err error
+	for try := 0; try < 3; try++ {
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+		if err != nil {
+			return nil, err
+		}
+		fs.f, err = os.Create(fs.tmp)
+		if !os.IsNotExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+
+}
+
+func (fs *FileSink) Write(p []byte) (int, error) {
+	return fs.f.Write(p)
+}
+
+func (fs *FileSink) Close() error {
+
+	err := fs.f.Sync()
+	if err != nil {
+		fs.Abort()
+		return err
+	}
+
+	err = fs.f.Close()
+	if err != nil {
+		os.Remove(fs.tmp)
+		return err
+	}
+
+	err = os.Rename(fs.tmp, fs.file)
+	if err != nil {
+		os.Remove(fs.tmp)
+		return err
+	}
+
+	return nil
+
+}
+
+func (fs *FileSink) Abort() error {
+	fs.f.Close()
+	return os.Remove(fs.tmp)
+}
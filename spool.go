@@ -0,0 +1,284 @@
+package main
+
+// Local disk spool for finished Parquet objects.  Each object is written to
+// the spool before upload and only removed once the upload has succeeded, so
+// a bucket outage or a crash doesn't lose a batch.  The spool directory
+// mirrors the object path, which lets a restart re-upload anything left
+// behind.  That only works if the directory outlives the process, on
+// Kubernetes it needs to be a persistent volume rather than an emptyDir.
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Upload retry backoff.
+const (
+	minUploadBackoff = time.Second
+	maxUploadBackoff = 5 * time.Minute
+)
+
+var errSpoolFileGone = errors.New("spool file has gone")
+
+type Spool struct {
+	dir     string
+	storage Storage
+
+	// Objects awaiting upload, oldest first.
+	lock    sync.Mutex
+	pending []spoolEntry
+	wake    chan struct{}
+}
+
+// A spooled object, and the handlers waiting for it to be uploaded.  data
+// is set for an object held in memory because it couldn't be spooled.
+type spoolEntry struct {
+	path string
+	data []byte
+	acks []chan error
+}
+
+func NewSpool(dir string, storage Storage) (*Spool, error) {
+
+	dir = filepath.Clean(dir)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	sp := &Spool{
+		dir:     dir,
+		storage: storage,
+		wake:    make(chan struct{}, 1),
+	}
+
+	return sp, nil
+
+}
+
+// Scans the spool for objects left by a previous run and queues them for
+// upload.  Partially written files are discarded.
+func (sp *Spool) Recover() error {
+
+	return filepath.Walk(sp.dir, func(file string, info os.FileInfo,
+		err error) error {
+
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		if strings.HasSuffix(file, tmpSuffix) {
+			utils.Log("Removing partial spool file %s", file)
+			return os.Remove(file)
+		}
+
+		rel, err := filepath.Rel(sp.dir, file)
+		if err != nil {
+			return err
+		}
+
+		utils.Log("Recovered %s from spool", rel)
+		sp.Queue(filepath.ToSlash(rel), nil)
+
+		return nil
+
+	})
+
+}
+
+// Returns a sink which writes an object to the spool.  Once the sink is
+// closed the object must be queued for upload with Queue.  Until then it's
+// a temporary file which Recover discards.
+func (sp *Spool) Create(path string) (Sink, error) {
+	return NewFileSink(sp.file(path))
+}
+
+// Writes an object to the spool and queues it for upload.  acks are
+// completed once the upload succeeds.
+func (sp *Spool) Put(path string, data []byte, acks []chan error) error {
+
+	err := uploadTo(sp.Create, path, data)
+	if err != nil {
+		return err
+	}
+
+	sp.Queue(path, acks)
+
+	return nil
+
+}
+
+// Number of objects not yet uploaded.
+func (sp *Spool) Pending() int {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	return len(sp.pending)
+}
+
+// Waits until every spooled object has been uploaded, or the deadline
+// passes.  Returns the number of objects still pending.
+func (sp *Spool) Wait(deadline time.Time) int {
+
+	for {
+		n := sp.Pending()
+		if n == 0 || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+}
+
+// Upload loop, uploads spooled objects in order and retries failures with
+// exponential backoff.  Never returns.
+func (sp *Spool) Run() {
+
+	for {
+
+		sp.lock.Lock()
+		if len(sp.pending) == 0 {
+			sp.lock.Unlock()
+			<-sp.wake
+			continue
+		}
+		ent := sp.pending[0]
+		sp.lock.Unlock()
+
+		backoff := minUploadBackoff
+		var err error
+		for {
+			err = sp.upload(ent)
+			if err == nil || err == errSpoolFileGone {
+				break
+			}
+			utils.Log("Couldn't upload %s, retrying in %v: %s", ent.path,
+				backoff, err.Error())
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxUploadBackoff {
+				backoff = maxUploadBackoff
+			}
+		}
+
+		sp.lock.Lock()
+		sp.pending = sp.pending[1:]
+		sp.lock.Unlock()
+
+		// A vanished file can't be uploaded, have its events redelivered.
+		if err != nil {
+			utils.Log("Couldn't upload %s: %s", ent.path, err.Error())
+		}
+		complete(ent.acks, err)
+
+	}
+
+}
+
+// Uploads a single spooled object, removing it from the spool on success.
+func (sp *Spool) upload(ent spoolEntry) error {
+
+	if ent.data != nil {
+		return sp.storage.Upload(ent.path, ent.data)
+	}
+
+	file := sp.file(ent.path)
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return errSpoolFileGone
+	}
+	if err != nil {
+		return err
+	}
+
+	err = sp.send(ent.path, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(file)
+	if err != nil {
+		utils.Log("Couldn't remove spool file %s: %s", file, err.Error())
+	}
+
+	// Tidy up the directories the object path created.
+	for dir := filepath.Dir(file); dir != sp.dir; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+
+}
+
+// Sends an object to storage.  Streamed if the storage can, so the object
+// is never held in memory in its entirety.
+func (sp *Spool) send(path string, f *os.File) error {
+
+	st, ok := sp.storage.(StreamingStorage)
+	if !ok {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		return sp.storage.Upload(path, data)
+	}
+
+	sink, err := st.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(sink, f)
+	if err != nil {
+		sink.Abort()
+		return err
+	}
+
+	return sink.Close()
+
+}
+
+// Queues a spooled object for upload.  acks are completed once the upload
+// succeeds.
+func (sp *Spool) Queue(path string, acks []chan error) {
+	sp.enqueue(spoolEntry{path: path, acks: acks})
+}
+
+func (sp *Spool) enqueue(ent spoolEntry) {
+
+	sp.lock.Lock()
+	sp.pending = append(sp.pending, ent)
+	sp.lock.Unlock()
+
+	select {
+	case sp.wake <- struct{}{}:
+	default:
+	}
+
+}
+
+// Queues an object which couldn't be written to the spool.  It's retried
+// like any other, but is lost if the process exits before it's uploaded.
+func (sp *Spool) Hold(path string, data []byte, acks []chan error) {
+	sp.enqueue(spoolEntry{path: path, data: data, acks: acks})
+}
+
+// Spool filename for an object path.
+func (sp *Spool) file(path string) string {
+	return filepath.Join(sp.dir, filepath.FromSlash(path))
+}
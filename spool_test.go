@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Storage which fails the first few uploads.
+type flakyStorage struct {
+	lock     sync.Mutex
+	failures int
+	objects  map[string][]byte
+}
+
+func (fs *flakyStorage) Upload(path string, data []byte) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.failures > 0 {
+		fs.failures--
+		return errors.New("unavailable")
+	}
+	fs.objects[path] = data
+	return nil
+}
+
+func newTestSpool(t *testing.T, failures int) (*Spool, *flakyStorage,
+	string) {
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := &flakyStorage{failures: failures, objects: map[string][]byte{}}
+
+	sp, err := NewSpool(dir, st)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return sp, st, dir
+
+}
+
+func waitAck(t *testing.T, ack chan error) error {
+	select {
+	case err := <-ack:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("not acknowledged")
+		return nil
+	}
+}
+
+// An object whose spool file has vanished was never stored, so its events
+// must be redelivered rather than acknowledged.
+func TestSpoolFileGone(t *testing.T) {
+
+	sp, st, dir := newTestSpool(t, 0)
+	defer os.RemoveAll(dir)
+	go sp.Run()
+
+	ack := make(chan error, 1)
+	sp.Queue("a/object.parquet", []chan error{ack})
+
+	if waitAck(t, ack) == nil {
+		t.Error("missing object acknowledged")
+	}
+	if len(st.objects) != 0 {
+		t.Error("missing object stored")
+	}
+	if sp.Pending() != 0 {
+		t.Error("missing object left pending")
+	}
+
+}
+
+// An object held in memory is retried until it's uploaded.
+func TestSpoolHoldRetries(t *testing.T) {
+
+	sp, st, dir := newTestSpool(t, 1)
+	defer os.RemoveAll(dir)
+	go sp.Run()
+
+	ack := make(chan error, 1)
+	sp.Hold("a/object.parquet", []byte("data"), []chan error{ack})
+
+	err := waitAck(t, ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if string(st.objects["a/object.parquet"]) != "data" {
+		t.Errorf("stored %q", st.objects["a/object.parquet"])
+	}
+
+}
@@ -0,0 +1,169 @@
+package main
+
+// Storage backends.  Every backend can upload a whole object, most can also
+// stream an object, either from the spool or as it's written.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	"github.com/trustnetworks/analytics-common/cloudstorage"
+	"github.com/trustnetworks/analytics-common/utils"
+	"google.golang.org/api/option"
+)
+
+// Where finished objects go.
+type Storage interface {
+	Upload(path string, data []byte) error
+}
+
+// A Storage which can stream objects.  The object only appears once the
+// sink is closed.
+type StreamingStorage interface {
+	Storage
+	Create(path string) (Sink, error)
+}
+
+// Default root directory for local storage.
+const defaultStorageRoot = "data"
+
+// GCS upload chunk size.  Each chunk is buffered, then sent as part of a
+// resumable upload.
+const gcsChunkSize = 16 * 1024 * 1024
+
+// Returns the storage backend for a platform.  If stream is set the backend
+// must support streaming.
+func NewStorage(platform string, stream bool) (Storage, error) {
+
+	var st Storage
+	var err error
+
+	// Every platform known here can stream, which also lets the spool
+	// upload from file without reading the whole object into memory.
+	// s3 is for S3-compatible stores.  aws goes through cloudstorage like
+	// any other platform, unless streaming needs the s3 backend.
+	switch platform {
+	case "local":
+		st, err = newLocalStorage(utils.Getenv("STORAGE_ROOT",
+			defaultStorageRoot))
+	case "hdfs":
+		st, err = newHdfsStorage()
+	case "s3":
+		st, err = newS3Storage()
+	case "aws":
+		if stream {
+			st, err = newS3Storage()
+			break
+		}
+		cs := cloudstorage.New(platform)
+		cs.Init("STORAGE_BUCKET", "")
+		st = cs
+	case "gcp":
+		cs := cloudstorage.New(platform)
+		cs.Init("STORAGE_BUCKET", "")
+		st, err = newGcsStorage(cs)
+	default:
+		cs := cloudstorage.New(platform)
+		cs.Init("STORAGE_BUCKET", "")
+		st = cs
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := st.(StreamingStorage); stream && !ok {
+		return nil, fmt.Errorf("streaming upload not supported on %s",
+			platform)
+	}
+
+	return st, nil
+
+}
+
+// GCS storage, whole objects go through cloudstorage, streamed objects use
+// a resumable upload.
+type gcsStorage struct {
+	cloudstorage.CloudStorage
+	bucket *storage.BucketHandle
+}
+
+func newGcsStorage(cs cloudstorage.CloudStorage) (*gcsStorage, error) {
+
+	key := utils.Getenv("KEY", "private.json")
+	bucket := utils.Getenv("STORAGE_BUCKET", "")
+
+	client, err := storage.NewClient(context.Background(),
+		option.WithCredentialsFile(key))
+	if err != nil {
+		return nil, err
+	}
+
+	g := &gcsStorage{
+		CloudStorage: cs,
+		bucket:       client.Bucket(bucket),
+	}
+
+	return g, nil
+
+}
+
+func (g *gcsStorage) Create(path string) (Sink, error) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := g.bucket.Object(path).NewWriter(ctx)
+	w.ChunkSize = gcsChunkSize
+
+	return &gcsObjectWriter{Writer: w, cancel: cancel}, nil
+
+}
+
+type gcsObjectWriter struct {
+	*storage.Writer
+	cancel context.CancelFunc
+}
+
+func (w *gcsObjectWriter) Close() error {
+	defer w.cancel()
+	return w.Writer.Close()
+}
+
+// Cancelling the context stops the upload without creating the object.
+func (w *gcsObjectWriter) Abort() error {
+	w.cancel()
+	w.Writer.Close()
+	return nil
+}
+
+// Local filesystem storage, objects are written under a root directory.
+// Objects are renamed into place once complete, so readers never see a
+// partial object.
+type localStorage struct {
+	root string
+}
+
+func newLocalStorage(root string) (*localStorage, error) {
+
+	root = filepath.Clean(root)
+
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	utils.Log("Storing objects under %s", root)
+
+	return &localStorage{root: root}, nil
+
+}
+
+func (l *localStorage) Upload(path string, data []byte) error {
+	return uploadTo(l.Create, path, data)
+}
+
+func (l *localStorage) Create(path string) (Sink, error) {
+	return NewFileSink(filepath.Join(l.root, filepath.FromSlash(path)))
+}